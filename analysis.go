@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const VELOCITY_BINS = 16 // velocity histogram resolution, 8 values per bin
+
+const ANALYSIS_SAVE_DELAY = 10 * time.Second // analyses are saved to the index in batches
+
+// Analysis describes how a single recording was played
+type Analysis struct {
+	Velocity       [VELOCITY_BINS]int `json:"velocity"`       // histogram of note on velocities
+	AvgPolyphony   float64            `json:"avgPolyphony"`   // keys held down on average while playing
+	PeakPolyphony  int                `json:"peakPolyphony"`  // most keys held down at once
+	NotesPerMinute []int              `json:"notesPerMinute"` // notes played in each minute of the recording
+	SustainRatio   float64            `json:"sustainRatio"`   // part of the recording with sustain pedal down
+	Lowest         byte               `json:"lowest"`         // midi note, 0 when no notes
+	Highest        byte               `json:"highest"`        // midi note, 0 when no notes
+	Split          byte               `json:"split"`          // estimated lowest note of the right hand
+	LeftNotes      int                `json:"leftNotes"`      // notes below the split
+	RightNotes     int                `json:"rightNotes"`     // notes from the split up
+	LongestGap     float64            `json:"longestGap"`     // seconds of the longest silence between notes
+}
+
+// Analyses the events of a recording
+func analyse(events []TimedEvent) Analysis {
+	a := Analysis{NotesPerMinute: []int{}}
+	keys := [128]int{} // histogram of played notes
+	held := [128]bool{}
+	holding := 0
+	sustain := false
+	var end, last, sustainSince, sustained, playing, polyphonyTime time.Duration
+	var lastNoteOff time.Duration = -1 // nothing sounds before the first note
+	notes := 0
+
+	// accumulate time spent in the current state up to at
+	advance := func(at time.Duration) {
+		if holding > 0 {
+			playing += at - last
+			polyphonyTime += time.Duration(holding) * (at - last)
+		}
+		last = at
+	}
+
+	for _, ev := range events {
+		advance(ev.At)
+		end = ev.At
+		switch {
+		case ev.Cmd == CMD_NOTE_ON:
+			key := ev.Key & 0x7F
+			minute := int(ev.At / time.Minute)
+			for len(a.NotesPerMinute) <= minute {
+				a.NotesPerMinute = append(a.NotesPerMinute, 0)
+			}
+			a.NotesPerMinute[minute]++
+			a.Velocity[int(ev.Value&0x7F)*VELOCITY_BINS/128]++
+			keys[key]++
+			notes++
+			if holding == 0 && lastNoteOff >= 0 {
+				if gap := (ev.At - lastNoteOff).Seconds(); gap > a.LongestGap {
+					a.LongestGap = gap
+				}
+			}
+			if !held[key] {
+				held[key] = true
+				holding++
+			}
+			if holding > a.PeakPolyphony {
+				a.PeakPolyphony = holding
+			}
+		case ev.Cmd == CMD_NOTE_OFF:
+			key := ev.Key & 0x7F
+			if held[key] {
+				held[key] = false
+				holding--
+				if holding == 0 {
+					lastNoteOff = ev.At
+				}
+			}
+		case ev.Cmd == CMD_CONTROL_CHANGE && ev.Key == CC_SUTAIN:
+			down := ev.Value >= 64
+			if down && !sustain {
+				sustainSince = ev.At
+			}
+			if !down && sustain {
+				sustained += ev.At - sustainSince
+			}
+			sustain = down
+		}
+	}
+	if sustain {
+		sustained += end - sustainSince
+	}
+
+	if end > 0 {
+		a.SustainRatio = float64(sustained) / float64(end)
+	}
+	if playing > 0 {
+		a.AvgPolyphony = float64(polyphonyTime) / float64(playing)
+	}
+	if notes == 0 {
+		return a
+	}
+	a.Lowest, a.Highest = 127, 0
+	for k := 0; k < 128; k++ {
+		if keys[k] > 0 {
+			if byte(k) < a.Lowest {
+				a.Lowest = byte(k)
+			}
+			a.Highest = byte(k)
+		}
+	}
+	a.Split = handSplit(keys, a.Lowest, a.Highest)
+	for k := 0; k < 128; k++ {
+		if k < int(a.Split) {
+			a.LeftNotes += keys[k]
+		} else {
+			a.RightNotes += keys[k]
+		}
+	}
+	return a
+}
+
+// Estimates the split between hands by dividing played notes into two groups
+// with the least variance of pitch (otsu's method on the key histogram)
+func handSplit(keys [128]int, lowest, highest byte) byte {
+	total, sum := 0, 0.0
+	for k := int(lowest); k <= int(highest); k++ {
+		total += keys[k]
+		sum += float64(k * keys[k])
+	}
+	split, splitEnd, best := lowest, lowest, 0.0 // all in right hand unless there are two groups
+	leftCount, leftSum := 0, 0.0
+	for k := int(lowest) + 1; k <= int(highest); k++ {
+		leftCount += keys[k-1]
+		leftSum += float64((k - 1) * keys[k-1])
+		rightCount := total - leftCount
+		if leftCount == 0 || rightCount == 0 {
+			continue
+		}
+		diff := leftSum/float64(leftCount) - (sum-leftSum)/float64(rightCount)
+		between := float64(leftCount) * float64(rightCount) * diff * diff
+		if between > best {
+			best, split, splitEnd = between, byte(k), byte(k)
+		} else if between == best {
+			splitEnd = byte(k) // unplayed keys between hands, split in the middle
+		}
+	}
+	return (split + splitEnd) / 2
+}
+
+// Returns analysis of recording by its id, analysing the file when not cached yet
+// the file is analysed unlocked, so a large one doesn't hold the refresh
+func (a *Archive) Analysis(id string) (Analysis, error) {
+	rel, entry, ok := a.find(id)
+	if !ok {
+		return Analysis{}, errNotFound
+	}
+	if entry.Analysis != nil {
+		return *entry.Analysis, nil
+	}
+	events, err := readSMFEvents(a.Path(rel))
+	if err != nil {
+		return Analysis{}, err
+	}
+	analysis := analyse(events)
+	info, err := os.Stat(a.Path(rel))
+	if err != nil || info.Size() != entry.Size || !info.ModTime().Equal(entry.ModTime) {
+		return analysis, nil // changed since indexed, cached after refresh
+	}
+
+	a.refreshMu.Lock() // entries can't be replaced meanwhile
+	defer a.refreshMu.Unlock()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	current, ok := a.entries[rel]
+	if !ok || current.Size != entry.Size || !current.ModTime.Equal(entry.ModTime) {
+		return analysis, nil
+	}
+	current.Analysis = &analysis
+	a.entries[rel] = current
+	if a.saveTimer == nil { // analyses made meanwhile are saved at once
+		a.saveTimer = time.AfterFunc(ANALYSIS_SAVE_DELAY, a.saveAnalyses)
+	}
+	return analysis, nil
+}
+
+// Saves the index with analyses cached since it was saved
+func (a *Archive) saveAnalyses() {
+	a.refreshMu.Lock()
+	defer a.refreshMu.Unlock()
+	a.mu.Lock()
+	a.saveTimer = nil
+	a.mu.Unlock()
+	// entries are replaced only under refreshMu
+	if err := saveIndex(filepath.Join(a.dir, INDEX_FILE), a.entries); err != nil {
+		log.Println("Can't save index", err)
+	}
+}
+
+// Registers http api for analysis of recordings
+func handleAnalysis(r *mux.Router, archive *Archive) {
+	r.HandleFunc("/archive/{id:"+ID_PATTERN+"}/analysis", func(w http.ResponseWriter, r *http.Request) {
+		setupResponse(&w, r)
+		analysis, err := archive.Analysis(mux.Vars(r)["id"])
+		if err == errNotFound {
+			http.Error(w, "recording not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(analysis)
+	}).Methods(http.MethodGet)
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const ID_PATTERN = "[0-9a-f]{12}" // recording id in urls
+
+// fields of recording in json
+const (
+	FIELD_ID       = "id"
+	FIELD_TIME     = "t"
+	FIELD_DURATION = "d"
+	FIELD_NOTES    = "n"
+	FIELD_KEYS     = "k"
+)
+
+// ArchiveQuery selects recordings from the archive
+type ArchiveQuery struct {
+	From        time.Time // zero for unlimited
+	To          time.Time // zero for unlimited
+	MinDuration time.Duration
+	MinNotes    int64
+	Sort        string // field to sort by, prefixed by - for descending order
+	Offset      int
+	Limit       int             // zero for unlimited
+	Fields      map[string]bool // fields to be encoded, empty for all
+}
+
+// Parses time given as unix timestamp or local date (YYYY-MM-DD)
+// date is resolved to its start, or its end if endOfDay is set
+func parseQueryTime(value string, endOfDay bool) (time.Time, error) {
+	if unix, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(unix, 0), nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", value, time.Local)
+	if err != nil {
+		return t, fmt.Errorf("invalid time %q", value)
+	}
+	if endOfDay {
+		t = t.AddDate(0, 0, 1).Add(-time.Nanosecond)
+	}
+	return t, nil
+}
+
+// Parses query from url parameters:
+// from, to - unix timestamp or date
+// minDuration - seconds, minNotes
+// sort - t, d or n, prefixed by - for descending order (default t)
+// offset, limit - pagination
+// fields - comma separated list of id, t, d, n, k
+func parseArchiveQuery(values url.Values) (q ArchiveQuery, err error) {
+	q.Sort = FIELD_TIME
+	q.Fields = map[string]bool{}
+	if v := values.Get("from"); v != "" {
+		if q.From, err = parseQueryTime(v, false); err != nil {
+			return
+		}
+	}
+	if v := values.Get("to"); v != "" {
+		if q.To, err = parseQueryTime(v, true); err != nil {
+			return
+		}
+	}
+	ints := map[string]*int{"offset": &q.Offset, "limit": &q.Limit}
+	for name, dest := range ints {
+		if v := values.Get(name); v != "" {
+			if *dest, err = strconv.Atoi(v); err != nil || *dest < 0 {
+				return q, fmt.Errorf("invalid %s %q", name, v)
+			}
+		}
+	}
+	if v := values.Get("minDuration"); v != "" {
+		seconds, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return q, fmt.Errorf("invalid minDuration %q", v)
+		}
+		q.MinDuration = time.Duration(seconds * float64(time.Second))
+	}
+	if v := values.Get("minNotes"); v != "" {
+		if q.MinNotes, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return q, fmt.Errorf("invalid minNotes %q", v)
+		}
+	}
+	if v := values.Get("sort"); v != "" {
+		switch strings.TrimPrefix(v, "-") {
+		case FIELD_TIME, FIELD_DURATION, FIELD_NOTES:
+			q.Sort = v
+		default:
+			return q, fmt.Errorf("invalid sort %q", v)
+		}
+	}
+	if v := values.Get("fields"); v != "" {
+		for _, field := range strings.Split(v, ",") {
+			switch field {
+			case FIELD_ID, FIELD_TIME, FIELD_DURATION, FIELD_NOTES, FIELD_KEYS:
+				q.Fields[field] = true
+			default:
+				return q, fmt.Errorf("invalid field %q", field)
+			}
+		}
+	}
+	return q, nil
+}
+
+// Returns recordings matching the query (sorted) and their total count before pagination
+func (q ArchiveQuery) Apply(recordings Recordings) (Recordings, int) {
+	matching := Recordings{}
+	for _, rec := range recordings {
+		if !q.From.IsZero() && rec.Time.Before(q.From) ||
+			!q.To.IsZero() && rec.Time.After(q.To) ||
+			rec.Duration < q.MinDuration || rec.Notes < q.MinNotes {
+			continue
+		}
+		matching = append(matching, rec)
+	}
+
+	desc := strings.HasPrefix(q.Sort, "-")
+	less := func(a, b Recording) bool {
+		switch strings.TrimPrefix(q.Sort, "-") {
+		case FIELD_DURATION:
+			return a.Duration < b.Duration
+		case FIELD_NOTES:
+			return a.Notes < b.Notes
+		default:
+			return a.Time.Before(b.Time)
+		}
+	}
+	sort.SliceStable(matching, func(i, j int) bool {
+		if desc {
+			return less(matching[j], matching[i])
+		}
+		return less(matching[i], matching[j])
+	})
+
+	total := len(matching)
+	if q.Offset >= total {
+		return Recordings{}, total
+	}
+	matching = matching[q.Offset:]
+	if q.Limit > 0 && q.Limit < len(matching) {
+		matching = matching[:q.Limit]
+	}
+	return matching, total
+}
+
+// Encodes recordings with selected fields only
+func (q ArchiveQuery) Encode(recordings Recordings) []map[string]interface{} {
+	all := len(q.Fields) == 0
+	list := make([]map[string]interface{}, 0, len(recordings))
+	for _, rec := range recordings {
+		item := map[string]interface{}{}
+		if all || q.Fields[FIELD_ID] {
+			item[FIELD_ID] = rec.ID
+		}
+		if all || q.Fields[FIELD_TIME] {
+			item[FIELD_TIME] = rec.Time.Unix()
+		}
+		if all || q.Fields[FIELD_DURATION] {
+			item[FIELD_DURATION] = int64(rec.Duration.Seconds())
+		}
+		if all || q.Fields[FIELD_NOTES] {
+			item[FIELD_NOTES] = rec.Notes
+		}
+		if (all || q.Fields[FIELD_KEYS]) && rec.Keys != nil {
+			item[FIELD_KEYS] = (*rec.Keys)[:]
+		}
+		list = append(list, item)
+	}
+	return list
+}
+
+// PeriodStats sums recordings of single day, week or month
+type PeriodStats struct {
+	Start    int64 `json:"t"` // unix time of period start
+	Duration int64 `json:"d"` // seconds of playing
+	Notes    int64 `json:"n"`
+	Count    int   `json:"c"` // number of recordings
+}
+
+// ArchiveStats sums recordings of a range
+type ArchiveStats struct {
+	Period   string        `json:"period"`
+	Periods  []PeriodStats `json:"periods"`
+	Duration int64         `json:"d"`
+	Notes    int64         `json:"n"`
+	Count    int           `json:"c"`
+	Keys     []int         `json:"k"` // histogram of keys
+}
+
+// Returns start of day, week (monday) or month of given time
+func periodStart(t time.Time, period string) time.Time {
+	y, m, d := t.Date()
+	switch period {
+	case "week":
+		weekday := (int(t.Weekday()) + 6) % 7 // monday is 0
+		return time.Date(y, m, d-weekday, 0, 0, 0, 0, t.Location())
+	case "month":
+		return time.Date(y, m, 1, 0, 0, 0, 0, t.Location())
+	default:
+		return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+	}
+}
+
+// Aggregates recordings by period (day, week or month)
+func archiveStats(recordings Recordings, period string) ArchiveStats {
+	stats := ArchiveStats{
+		Period:  period,
+		Periods: []PeriodStats{},
+		Keys:    make([]int, len(Keys88{})),
+	}
+	byStart := map[int64]*PeriodStats{}
+	for _, rec := range recordings {
+		start := periodStart(rec.Time, period).Unix()
+		ps, ok := byStart[start]
+		if !ok {
+			ps = &PeriodStats{Start: start}
+			byStart[start] = ps
+		}
+		seconds := int64(rec.Duration.Seconds())
+		ps.Duration += seconds
+		ps.Notes += rec.Notes
+		ps.Count++
+		stats.Duration += seconds
+		stats.Notes += rec.Notes
+		stats.Count++
+		if rec.Keys != nil {
+			for i, n := range rec.Keys {
+				stats.Keys[i] += n
+			}
+		}
+	}
+	for _, ps := range byStart {
+		stats.Periods = append(stats.Periods, *ps)
+	}
+	sort.Slice(stats.Periods, func(i, j int) bool {
+		return stats.Periods[i].Start < stats.Periods[j].Start
+	})
+	return stats
+}
+
+// Registers http api for querying the archive
+// recordings returns current list of recordings
+func handleArchive(r *mux.Router, recordings func() Recordings) {
+	// Return json containing data of recordings obtained from names of mid files created from pianoteq
+	// total count of matching recordings is in X-Total-Count header
+	r.HandleFunc("/archive.json", func(w http.ResponseWriter, r *http.Request) {
+		setupResponse(&w, r)
+		q, err := parseArchiveQuery(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		page, total := q.Apply(recordings())
+		w.Header().Set("X-Total-Count", strconv.Itoa(total))
+		w.Header().Set("Access-Control-Expose-Headers", "X-Total-Count")
+		json.NewEncoder(w).Encode(q.Encode(page))
+	}).Methods(http.MethodGet)
+
+	// totals of playing time and notes per day, week or month
+	// accepts the same filters as archive.json
+	r.HandleFunc("/archive/stats", func(w http.ResponseWriter, r *http.Request) {
+		setupResponse(&w, r)
+		q, err := parseArchiveQuery(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		period := r.URL.Query().Get("period")
+		switch period {
+		case "":
+			period = "day"
+		case "day", "week", "month":
+		default:
+			http.Error(w, "invalid period", http.StatusBadRequest)
+			return
+		}
+		q.Offset, q.Limit = 0, 0
+		matching, _ := q.Apply(recordings())
+		json.NewEncoder(w).Encode(archiveStats(matching, period))
+	}).Methods(http.MethodGet)
+}
+
+// NoteEvents is compact form of recording for drawing piano roll
+type NoteEvents struct {
+	ID       string     `json:"id"`
+	Duration int64      `json:"d"`       // milliseconds
+	Notes    [][4]int64 `json:"notes"`   // start ms, duration ms, key, velocity
+	Sustain  [][2]int64 `json:"sustain"` // start ms, duration ms of pressed pedal
+}
+
+// Pairs note ons with note offs of the events
+// notes still sounding at the end last until the end
+func noteEvents(id string, events []TimedEvent) NoteEvents {
+	ne := NoteEvents{ID: id, Notes: [][4]int64{}, Sustain: [][2]int64{}}
+	ms := func(d time.Duration) int64 { return int64(d / time.Millisecond) }
+	started := map[byte]int{} // index of sounding note by key
+	sustainSince := int64(-1)
+	end := int64(0)
+	release := func(key byte, at int64) {
+		if i, ok := started[key]; ok {
+			ne.Notes[i][1] = at - ne.Notes[i][0]
+			delete(started, key)
+		}
+	}
+	for _, ev := range events {
+		at := ms(ev.At)
+		end = at
+		switch {
+		case ev.Cmd == CMD_NOTE_ON:
+			release(ev.Key, at) // retriggered without note off
+			started[ev.Key] = len(ne.Notes)
+			ne.Notes = append(ne.Notes, [4]int64{at, 0, int64(ev.Key), int64(ev.Value)})
+		case ev.Cmd == CMD_NOTE_OFF:
+			release(ev.Key, at)
+		case ev.Cmd == CMD_CONTROL_CHANGE && ev.Key == CC_SUTAIN:
+			if ev.Value >= 64 && sustainSince < 0 {
+				sustainSince = at
+			}
+			if ev.Value < 64 && sustainSince >= 0 {
+				ne.Sustain = append(ne.Sustain, [2]int64{sustainSince, at - sustainSince})
+				sustainSince = -1
+			}
+		}
+	}
+	for key := range started {
+		release(key, end)
+	}
+	if sustainSince >= 0 {
+		ne.Sustain = append(ne.Sustain, [2]int64{sustainSince, end - sustainSince})
+	}
+	ne.Duration = end
+	return ne
+}
+
+// Registers http api for single recordings of the archive
+func handleRecording(r *mux.Router, archive *Archive) {
+	get := func(w http.ResponseWriter, r *http.Request) (Recording, string, bool) {
+		rec, rel, err := archive.Get(mux.Vars(r)["id"])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return rec, "", false
+		}
+		return rec, rel, true
+	}
+
+	// files of the archive which couldn't be parsed
+	r.HandleFunc("/archive/errors", func(w http.ResponseWriter, r *http.Request) {
+		setupResponse(&w, r)
+		json.NewEncoder(w).Encode(archive.Errors())
+	}).Methods(http.MethodGet)
+
+	// metadata of recording, path can be used for playback
+	r.HandleFunc("/archive/{id:"+ID_PATTERN+"}", func(w http.ResponseWriter, r *http.Request) {
+		setupResponse(&w, r)
+		rec, rel, ok := get(w, r)
+		if !ok {
+			return
+		}
+		item := ArchiveQuery{}.Encode(Recordings{rec})[0]
+		item["path"] = rel
+		json.NewEncoder(w).Encode(item)
+	}).Methods(http.MethodGet)
+
+	// the original mid file
+	r.HandleFunc("/archive/{id:"+ID_PATTERN+"}.mid", func(w http.ResponseWriter, r *http.Request) {
+		setupResponse(&w, r)
+		_, rel, ok := get(w, r)
+		if !ok {
+			return
+		}
+		pathname := archive.Path(rel)
+		w.Header().Set("Content-Type", "audio/midi")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filepath.Base(pathname)))
+		http.ServeFile(w, r, pathname)
+	}).Methods(http.MethodGet)
+
+	// notes of recording for piano roll
+	r.HandleFunc("/archive/{id:"+ID_PATTERN+"}.json", func(w http.ResponseWriter, r *http.Request) {
+		setupResponse(&w, r)
+		rec, rel, ok := get(w, r)
+		if !ok {
+			return
+		}
+		events, err := readSMFEvents(archive.Path(rel))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(noteEvents(rec.ID, events))
+	}).Methods(http.MethodGet)
+}
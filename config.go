@@ -0,0 +1,325 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"runtime"
+	"strings"
+)
+
+var configPath = flag.String("config", "gopiano.json", "path to json config file")
+
+// flags overriding the config file
+var (
+	piancoAddr      = flag.String("addr", "", "pianco api ws address")
+	wledAddr        = flag.String("wled", "", "udp address of warls")
+	wledProto       = flag.String("proto", "", "led protocol (warls, drgb, drgbw, dnrgb, e131, artnet)")
+	dmxAddr         = flag.String("dmx", "", "udp address of e131 or artnet receiver (defaults to wled host)")
+	dmxUniverse     = flag.Int("universe", 0, "first dmx universe used by e131 or artnet")
+	dmxStartChannel = flag.Int("startchannel", 0, "dmx channel of the first led (1-512)")
+)
+
+// Config holds everything which differs between deployments
+type Config struct {
+	Listen      string                `json:"listen"`      // http api listen address
+	ArchiveDir  string                `json:"archiveDir"`  // pianoteq archive of mid files
+	ArchivePoll int                   `json:"archivePoll"` // seconds between archive scans when it can't be watched
+	Midi        MidiConfig            `json:"midi"`
+	Leds        LedsConfig            `json:"leds"`
+	Wled        WledConfig            `json:"wled"`
+	Dmx         DmxConfig             `json:"dmx"`
+	Pianco      PiancoConfig          `json:"pianco"`
+	Recorder    RecorderConfig        `json:"recorder"`
+	Sinks       map[string]SinkConfig `json:"sinks"`    // by name of the output
+	Playback    PlaybackConfig        `json:"playback"` // deprecated, use midi.out
+}
+
+type MidiConfig struct {
+	Channel int      `json:"channel"` // 0-15, every message is normalized to it
+	Inputs  []string `json:"inputs"`  // names or regexps of hardware ports to be opened
+	Virtual string   `json:"virtual"` // name of virtual input port, empty to disable
+	// processed events (normalized, played back, remote) are written to the outputs (midiout sink)
+	Out        string `json:"out"`        // name or regexp of hardware or synth port, empty for none
+	VirtualOut string `json:"virtualOut"` // name of virtual output port, empty to disable
+	// event categories passed to individual outputs (websocket, wled, recorder), empty passes all
+	Filters map[string][]string `json:"filters"`
+}
+
+type LedsConfig struct {
+	Keys      int    `json:"keys"`      // total keys (notes) to be lit
+	PerKey    int    `json:"perKey"`    // number of leds per single key
+	FirstLed  int    `json:"firstLed"`  // index of first led on the strip to be lit
+	FirstNote int    `json:"firstNote"` // midi value of first note to be lit
+	Count     int    `json:"count"`     // total leds on the strip, 0 to fit the keys exactly
+	Reversed  bool   `json:"reversed"`  // strip starts at the highest key
+	KeyMap    string `json:"keyMap"`    // json file with calibrated led ranges of keys
+	State     string `json:"state"`     // json file where visualizer state is kept, empty to not keep it
+	Presets   string `json:"presets"`   // json file with named looks of the visualizer, empty to not keep them
+}
+
+type WledConfig struct {
+	Addr     string `json:"addr"`     // udp address of realtime protocol
+	Api      string `json:"api"`      // http base url of json api, defaults to host of addr
+	Protocol string `json:"protocol"` // warls, drgb, drgbw, dnrgb, e131 or artnet
+}
+
+type DmxConfig struct {
+	Addr         string `json:"addr"`         // udp address of e131/artnet receiver, defaults to host of wled addr
+	Universe     int    `json:"universe"`     // first universe
+	StartChannel int    `json:"startChannel"` // channel of the first led (1-512)
+}
+
+type RecorderConfig struct {
+	Enabled bool `json:"enabled"` // record sessions to the archive dir (disable when pianoteq does it)
+	IdleGap int  `json:"idleGap"` // seconds without events closing the session
+}
+
+// Deprecated: playback.out is used as midi.out passing only played back events
+type PlaybackConfig struct {
+	Out string `json:"out"`
+}
+
+type SinkConfig struct {
+	Queue    int    `json:"queue"`    // events waiting for slow output
+	Overflow string `json:"overflow"` // what happens when the queue is full, oldest, newest or none
+	Disabled bool   `json:"disabled"` // can be enabled via http
+	// passed event sources (input, playback, remote) overriding the default ones, empty for default
+	Sources []string `json:"sources"`
+}
+
+// Returns config of the sink with defaults for missing values
+func (c Config) sinkConfig(name string) SinkConfig {
+	cfg := c.Sinks[name]
+	if cfg.Queue == 0 {
+		cfg.Queue = 256
+	}
+	if cfg.Overflow == "" {
+		cfg.Overflow = DROP_OLDEST
+	}
+	return cfg
+}
+
+type PiancoConfig struct {
+	Addr       string  `json:"addr"`       // pianco api ws address
+	UID        int     `json:"uid"`        // our user id (0-255)
+	Groups     []Group `json:"groups"`     // groups joined at start
+	QueueSize  int     `json:"queueSize"`  // messages kept while disconnected
+	Drop       string  `json:"drop"`       // which message is dropped when the queue is full, oldest or newest
+	MaxAge     int     `json:"maxAge"`     // seconds after which queued message is not worth sending, 0 for unlimited
+	UserColors bool    `json:"userColors"` // lit notes of other users by their colour instead of the color mode
+	// Deprecated: pianco.out is used as midi.out passing only remote events
+	Out string `json:"out"`
+}
+
+var config = defaultConfig()
+
+// Returns config with values used before the config file existed
+func defaultConfig() Config {
+	archiveDir := "/home/pi/.local/share/Modartt/Pianoteq/Archive"
+	if runtime.GOOS == "windows" { // for local testing
+		archiveDir = "./Archive"
+	}
+	return Config{
+		Listen:      ":1212",
+		ArchiveDir:  archiveDir,
+		ArchivePoll: 10,
+		Midi: MidiConfig{
+			Channel: 3, // this is what roland actually uses as output
+			Virtual: "gopiano",
+			Filters: map[string][]string{
+				"websocket": {EV_NOTE, EV_SUSTAIN, EV_SOSTENUTO, EV_SOFT},
+				"wled":      {EV_NOTE, EV_SUSTAIN, EV_SOSTENUTO},
+				"recorder":  {},
+			},
+		},
+		Leds: LedsConfig{ // 88 keys, two leds per key, skip first led, first note is A0
+			Keys:      88,
+			PerKey:    2,
+			FirstLed:  1,
+			FirstNote: NOTE_A0,
+			KeyMap:    "keymap.json",
+			State:     "visualizer.json",
+			Presets:   "presets.json",
+		},
+		Wled: WledConfig{
+			Addr:     "192.168.1.3:21324",
+			Protocol: "drgb",
+		},
+		Dmx: DmxConfig{
+			Universe:     1,
+			StartChannel: 1,
+		},
+		Pianco: PiancoConfig{
+			Addr:      "wss://pianoecho.draho.cz",
+			Groups:    []Group{{ID: 0, Send: true, Receive: true}},
+			QueueSize: 256,
+			Drop:      DROP_OLDEST,
+			MaxAge:    5,
+		},
+		Recorder: RecorderConfig{
+			Enabled: false,
+			IdleGap: 30,
+		},
+	}
+}
+
+// Loads config from json file, missing fields keep their default values
+// Missing file is not an error, defaults are used instead
+func loadConfig(path string) (Config, error) {
+	cfg := defaultConfig()
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		log.Println("No config file, using defaults:", path)
+		return cfg, nil
+	}
+	if err != nil {
+		return cfg, fmt.Errorf("failed to read config file: %s", err)
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("failed to parse config file: %s", err)
+	}
+	cfg.applyDeprecated()
+	return cfg, cfg.validate()
+}
+
+// Moves outputs of playback and pianco config to midi config
+// midiout sink passes only the sources they used to get, unless its sources are configured
+func (c *Config) applyDeprecated() {
+	explicit := c.Midi.Out != ""
+	sources := []string{}
+	for _, old := range []struct{ field, out, source string }{
+		{"playback.out", c.Playback.Out, SRC_PLAYBACK},
+		{"pianco.out", c.Pianco.Out, SRC_REMOTE},
+	} {
+		if old.out == "" {
+			continue
+		}
+		log.Println("Config", old.field, "is deprecated, use midi.out and sinks.midiout.sources")
+		if c.Midi.Out == "" {
+			c.Midi.Out = old.out
+		}
+		if explicit || c.Midi.Out != old.out {
+			log.Println("Ignoring", old.field, old.out, "in favour of midi out", c.Midi.Out)
+			continue
+		}
+		sources = append(sources, old.source)
+	}
+	if len(sources) == 0 {
+		return
+	}
+	sinks := map[string]SinkConfig{}
+	for name, cfg := range c.Sinks {
+		sinks[name] = cfg
+	}
+	cfg := sinks["midiout"]
+	if len(cfg.Sources) == 0 {
+		cfg.Sources = sources
+	}
+	sinks["midiout"] = cfg
+	c.Sinks = sinks
+}
+
+func (c Config) validate() error {
+	if c.Midi.Channel < 0 || c.Midi.Channel > 15 {
+		return fmt.Errorf("midi channel %d out of range", c.Midi.Channel)
+	}
+	for output, categories := range c.Midi.Filters {
+		if _, err := newEventFilter(categories); err != nil {
+			return fmt.Errorf("invalid %s filter: %s", output, err)
+		}
+	}
+	if c.Leds.Keys < 1 || c.Leds.PerKey < 1 || c.Leds.FirstLed < 0 {
+		return fmt.Errorf("invalid leds layout")
+	}
+	if c.Leds.Count != 0 && c.Leds.Count < c.Leds.FirstLed+c.Leds.Keys*c.Leds.PerKey {
+		return fmt.Errorf("leds count %d too small for the keys", c.Leds.Count)
+	}
+	for name := range c.Sinks {
+		cfg := c.sinkConfig(name)
+		if cfg.Queue < 0 {
+			return fmt.Errorf("invalid %s sink queue", name)
+		}
+		switch cfg.Overflow {
+		case DROP_OLDEST, DROP_NEWEST, DROP_NONE:
+		default:
+			return fmt.Errorf("unknown %s sink overflow %q", name, cfg.Overflow)
+		}
+		for _, src := range cfg.Sources {
+			switch src {
+			case SRC_INPUT, SRC_PLAYBACK, SRC_REMOTE:
+			default:
+				return fmt.Errorf("unknown %s sink source %q", name, src)
+			}
+		}
+	}
+	if c.Pianco.UID < 0 || c.Pianco.UID > 255 {
+		return fmt.Errorf("pianco uid out of range")
+	}
+	if c.Pianco.QueueSize < 1 {
+		return fmt.Errorf("pianco queue size has to be positive")
+	}
+	if c.Pianco.Drop != DROP_OLDEST && c.Pianco.Drop != DROP_NEWEST {
+		return fmt.Errorf("unknown pianco drop policy %q", c.Pianco.Drop)
+	}
+	if c.ArchivePoll < 1 {
+		return fmt.Errorf("archive poll interval has to be positive")
+	}
+	if c.Recorder.IdleGap < 1 {
+		return fmt.Errorf("recorder idle gap has to be positive")
+	}
+	if _, err := parseProtocol(c.Wled.Protocol); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Overrides config values by flags which were explicitly set
+func applyFlags(c *Config) {
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "addr":
+			c.Pianco.Addr = *piancoAddr
+		case "wled":
+			c.Wled.Addr = *wledAddr
+		case "proto":
+			c.Wled.Protocol = *wledProto
+		case "dmx":
+			c.Dmx.Addr = *dmxAddr
+		case "universe":
+			c.Dmx.Universe = *dmxUniverse
+		case "startchannel":
+			c.Dmx.StartChannel = *dmxStartChannel
+		}
+	})
+}
+
+// Returns http base url of the wled json api
+func (w WledConfig) apiUrl() string {
+	if w.Api != "" {
+		return strings.TrimRight(w.Api, "/")
+	}
+	return "http://" + strings.Split(w.Addr, ":")[0] + ":80"
+}
+
+// Returns address where the leds are sent by given protocol
+func (c Config) ledsAddr(proto int) string {
+	if proto == E131 || proto == ARTNET {
+		if c.Dmx.Addr != "" {
+			return c.Dmx.Addr
+		}
+		return strings.Split(c.Wled.Addr, ":")[0]
+	}
+	return c.Wled.Addr
+}
+
+// Returns number of leds on the strip
+func (l LedsConfig) total() int {
+	if l.Count == 0 {
+		return l.FirstLed + l.Keys*l.PerKey
+	}
+	return l.Count
+}
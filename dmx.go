@@ -0,0 +1,193 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// dmx based protocols, numbered after the wled realtime ones
+const (
+	E131 = DNRGB + 1 + iota
+	ARTNET
+)
+
+const (
+	DMX_UNIVERSE_SIZE   = 512  // channels per universe
+	E131_PORT           = 5568 // default port of sACN receivers
+	ARTNET_PORT         = 6454 // default port of Art-Net nodes
+	E131_HEADER_SIZE    = 126
+	ARTNET_HEADER_SIZE  = 18
+	E131_MAX_UNIVERSE   = 63999
+	ARTNET_MAX_UNIVERSE = 0x7FFF // 15 bit port address
+)
+
+var e131Identifier = []byte{0x41, 0x53, 0x43, 0x2d, 0x45, 0x31, 0x2e, 0x31, 0x37, 0x00, 0x00, 0x00}
+var artnetIdentifier = []byte("Art-Net\x00")
+
+// dmxTransport emits the led buffer as E1.31 (sACN) or Art-Net DMX universes
+// Every led takes 3 channels, leds are never split across two universes
+type dmxTransport struct {
+	proto        int
+	addr         string
+	conn         net.Conn
+	universe     int    // first universe to be used
+	startChannel int    // channel of first led in the first universe (1..512)
+	universes    int    // number of universes used by the strip
+	sequence     byte   // sequence number of packets
+	cid          []byte // sACN component identifier
+}
+
+// Creates transport for strip of given number of leds
+// all universes it takes have to be in range of the protocol
+func newDmxTransport(addr string, proto int, universe int, startChannel int, leds int) (*dmxTransport, error) {
+	if proto != E131 && proto != ARTNET {
+		return nil, fmt.Errorf("unsupported dmx protocol %d", proto)
+	}
+	if startChannel < 1 || startChannel > DMX_UNIVERSE_SIZE-2 {
+		return nil, fmt.Errorf("start channel %d out of range", startChannel)
+	}
+	universes := len(dmxUniverses(make([]byte, leds*3), startChannel))
+	last := universe + universes - 1
+	if proto == E131 && (universe < 1 || last > E131_MAX_UNIVERSE) {
+		return nil, fmt.Errorf("e1.31 universes %d-%d out of range", universe, last)
+	}
+	if proto == ARTNET && (universe < 0 || last > ARTNET_MAX_UNIVERSE) {
+		return nil, fmt.Errorf("art-net universes %d-%d out of range", universe, last)
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil { // use default port
+		port := E131_PORT
+		if proto == ARTNET {
+			port = ARTNET_PORT
+		}
+		addr = net.JoinHostPort(addr, fmt.Sprint(port))
+	}
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	cid := make([]byte, 16)
+	rand.Read(cid)
+	cid[6] = cid[6]&0x0F | 0x40 // uuid version 4
+	cid[8] = cid[8]&0x3F | 0x80
+	t := &dmxTransport{
+		proto:        proto,
+		addr:         addr,
+		conn:         conn,
+		universe:     universe,
+		startChannel: startChannel,
+		universes:    universes,
+		cid:          cid,
+	}
+	if proto == ARTNET { // zero disables sequencing in art-net
+		t.sequence = 1
+	}
+	return t, nil
+}
+
+// Send the buffer as dmx universes, wait is ignored as dmx has no realtime timeout
+func (t *dmxTransport) Send(buffer []byte, wait byte) error {
+	universes := dmxUniverses(buffer, t.startChannel)
+	if len(universes) > t.universes {
+		return fmt.Errorf("leds take %d universes, only %d are available", len(universes), t.universes)
+	}
+	for i, data := range universes {
+		var packet []byte
+		if t.proto == E131 {
+			packet = e131Packet(t.universe+i, t.sequence, t.cid, data)
+		} else {
+			packet = artnetPacket(t.universe+i, t.sequence, data)
+		}
+		if _, err := t.conn.Write(packet); err != nil {
+			return err
+		}
+	}
+	t.sequence++
+	if t.proto == ARTNET && t.sequence == 0 { // zero disables sequencing in art-net
+		t.sequence = 1
+	}
+	return nil
+}
+
+func (t *dmxTransport) Close() error {
+	return t.conn.Close()
+}
+
+// Splits led buffer to the dmx data of consecutive universes
+// first universe starts at startChannel, following ones at channel 1
+func dmxUniverses(buffer []byte, startChannel int) [][]byte {
+	universes := [][]byte{}
+	offset := startChannel - 1
+	buffer = buffer[:len(buffer)/3*3] // partial led is omitted
+	for len(buffer) > 0 {
+		leds := (DMX_UNIVERSE_SIZE - offset) / 3
+		if leds*3 > len(buffer) {
+			leds = len(buffer) / 3
+		}
+		data := make([]byte, offset+leds*3)
+		copy(data[offset:], buffer[:leds*3])
+		universes = append(universes, data)
+		buffer = buffer[leds*3:]
+		offset = 0
+	}
+	return universes
+}
+
+// Builds E1.31 data packet (ANSI E1.31-2016) carrying dmx data of one universe
+func e131Packet(universe int, sequence byte, cid []byte, data []byte) []byte {
+	packet := make([]byte, E131_HEADER_SIZE+len(data))
+	be := binary.BigEndian
+
+	// root layer
+	be.PutUint16(packet[0:], 0x0010) // preamble size
+	be.PutUint16(packet[2:], 0x0000) // postamble size
+	copy(packet[4:16], e131Identifier)
+	be.PutUint16(packet[16:], 0x7000|uint16(len(packet)-16))
+	be.PutUint32(packet[18:], 0x00000004) // VECTOR_ROOT_E131_DATA
+	copy(packet[22:38], cid)
+
+	// framing layer
+	be.PutUint16(packet[38:], 0x7000|uint16(len(packet)-38))
+	be.PutUint32(packet[40:], 0x00000002) // VECTOR_E131_DATA_PACKET
+	copy(packet[44:108], "gopiano")
+	packet[108] = 100             // priority
+	be.PutUint16(packet[109:], 0) // synchronization address
+	packet[111] = sequence
+	packet[112] = 0 // options
+	be.PutUint16(packet[113:], uint16(universe))
+
+	// dmp layer
+	be.PutUint16(packet[115:], 0x7000|uint16(len(packet)-115))
+	packet[117] = 0x02                              // VECTOR_DMP_SET_PROPERTY
+	packet[118] = 0xa1                              // address and data type
+	be.PutUint16(packet[119:], 0)                   // first property address
+	be.PutUint16(packet[121:], 1)                   // address increment
+	be.PutUint16(packet[123:], uint16(len(data)+1)) // property count including start code
+	packet[125] = 0                                 // dmx start code
+	copy(packet[E131_HEADER_SIZE:], data)
+
+	return packet
+}
+
+// Builds ArtDmx packet carrying dmx data of one universe (15 bit port address)
+func artnetPacket(universe int, sequence byte, data []byte) []byte {
+	length := len(data)
+	if length%2 == 1 { // length has to be even
+		length++
+	}
+	if length < 2 {
+		length = 2
+	}
+	packet := make([]byte, ARTNET_HEADER_SIZE+length)
+	copy(packet[0:8], artnetIdentifier)
+	binary.LittleEndian.PutUint16(packet[8:], 0x5000) // OpDmx
+	binary.BigEndian.PutUint16(packet[10:], 14)       // protocol version
+	packet[12] = sequence
+	packet[13] = 0                          // physical port
+	packet[14] = byte(universe & 0xFF)      // sub-net and universe
+	packet[15] = byte(universe >> 8 & 0x7F) // net
+	binary.BigEndian.PutUint16(packet[16:], uint16(length))
+	copy(packet[ARTNET_HEADER_SIZE:], data)
+	return packet
+}
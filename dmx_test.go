@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+var testCid = []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f, 0x10}
+
+func TestE131Packet(t *testing.T) {
+	want := []byte{
+		// root layer
+		0x00, 0x10, 0x00, 0x00,
+		0x41, 0x53, 0x43, 0x2d, 0x45, 0x31, 0x2e, 0x31, 0x37, 0x00, 0x00, 0x00,
+		0x70, 0x71, // flags and length 113
+		0x00, 0x00, 0x00, 0x04,
+	}
+	want = append(want, testCid...)
+	// framing layer
+	want = append(want, 0x70, 0x5b, 0x00, 0x00, 0x00, 0x02) // length 91
+	source := make([]byte, 64)
+	copy(source, "gopiano")
+	want = append(want, source...)
+	want = append(want,
+		0x64,       // priority
+		0x00, 0x00, // sync address
+		0x05,       // sequence
+		0x00,       // options
+		0x00, 0x07, // universe
+	)
+	// dmp layer
+	want = append(want,
+		0x70, 0x0e, // length 14
+		0x02, 0xa1,
+		0x00, 0x00, // first address
+		0x00, 0x01, // increment
+		0x00, 0x04, // count
+		0x00,             // start code
+		0xff, 0x80, 0x01, // data
+	)
+
+	got := e131Packet(7, 5, testCid, []byte{0xff, 0x80, 0x01})
+	if !bytes.Equal(got, want) {
+		t.Errorf("e131Packet\n got % x\nwant % x", got, want)
+	}
+}
+
+func TestArtnetPacket(t *testing.T) {
+	tests := []struct {
+		name     string
+		universe int
+		data     []byte
+		want     []byte
+	}{
+		{"odd length is padded", 0x123, []byte{0xff, 0x80, 0x01}, []byte{
+			'A', 'r', 't', '-', 'N', 'e', 't', 0x00,
+			0x00, 0x50, // OpDmx little endian
+			0x00, 0x0e, // version 14
+			0x09,       // sequence
+			0x00,       // physical
+			0x23, 0x01, // sub-uni and net
+			0x00, 0x04, // length
+			0xff, 0x80, 0x01, 0x00,
+		}},
+		{"empty has two channels", 0, nil, []byte{
+			'A', 'r', 't', '-', 'N', 'e', 't', 0x00,
+			0x00, 0x50,
+			0x00, 0x0e,
+			0x09,
+			0x00,
+			0x00, 0x00,
+			0x00, 0x02,
+			0x00, 0x00,
+		}},
+		{"net is 7 bits", 0xffff, []byte{0x01, 0x02}, []byte{
+			'A', 'r', 't', '-', 'N', 'e', 't', 0x00,
+			0x00, 0x50,
+			0x00, 0x0e,
+			0x09,
+			0x00,
+			0xff, 0x7f,
+			0x00, 0x02,
+			0x01, 0x02,
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := artnetPacket(tt.universe, 9, tt.data)
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("artnetPacket\n got % x\nwant % x", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDmxUniverses(t *testing.T) {
+	leds := func(n int) []byte {
+		buf := make([]byte, n*3)
+		for i := range buf {
+			buf[i] = byte(i/3 + 1) // every led has its own value
+		}
+		return buf
+	}
+	tests := []struct {
+		name         string
+		leds         int
+		startChannel int
+		sizes        []int // channels of every universe
+	}{
+		{"empty", 0, 1, []int{}},
+		{"fits one", 170, 1, []int{510}},
+		{"one led over", 171, 1, []int{510, 3}},
+		{"start channel shifts first", 170, 4, []int{510, 3}},
+		{"led is not split", 170, 5, []int{511, 3}},
+		{"three universes", 400, 1, []int{510, 510, 180}},
+		{"partial led is omitted", 0, 1, []int{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := leds(tt.leds)
+			universes := dmxUniverses(append(buf, 0xff, 0xff), tt.startChannel) // with 2 bytes of next led
+			if len(universes) != len(tt.sizes) {
+				t.Fatalf("got %d universes, want %d", len(universes), len(tt.sizes))
+			}
+			joined := []byte{}
+			for i, data := range universes {
+				if len(data) != tt.sizes[i] {
+					t.Errorf("universe %d has %d channels, want %d", i, len(data), tt.sizes[i])
+				}
+				if len(data) > DMX_UNIVERSE_SIZE {
+					t.Errorf("universe %d exceeds %d channels", i, DMX_UNIVERSE_SIZE)
+				}
+				if i == 0 {
+					offset := tt.startChannel - 1
+					if !bytes.Equal(data[:offset], make([]byte, offset)) {
+						t.Errorf("channels before start channel are not zero")
+					}
+					data = data[offset:]
+				}
+				joined = append(joined, data...)
+			}
+			if !bytes.Equal(joined, buf) {
+				t.Errorf("leds changed by splitting")
+			}
+		})
+	}
+}
+
+func TestDmxTransportRange(t *testing.T) {
+	tests := []struct {
+		name     string
+		proto    int
+		universe int
+		leds     int
+		ok       bool
+	}{
+		{"e131 first", E131, 1, 170, true},
+		{"e131 zero", E131, 0, 170, false},
+		{"e131 last", E131, E131_MAX_UNIVERSE, 170, true},
+		{"e131 over last", E131, E131_MAX_UNIVERSE, 171, false},
+		{"artnet zero", ARTNET, 0, 170, true},
+		{"artnet negative", ARTNET, -1, 170, false},
+		{"artnet over 15 bits", ARTNET, ARTNET_MAX_UNIVERSE - 1, 400, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr, err := newDmxTransport("127.0.0.1:9", tt.proto, tt.universe, 1, tt.leds)
+			if (err == nil) != tt.ok {
+				t.Fatalf("newDmxTransport error %v, want ok %v", err, tt.ok)
+			}
+			if err == nil {
+				tr.Close()
+			}
+		})
+	}
+}
+
+// dmx packet as seen by the receiver
+type receivedDmx struct {
+	universe int
+	sequence byte
+	data     []byte
+}
+
+func decodeDmx(t *testing.T, proto int, packet []byte) receivedDmx {
+	t.Helper()
+	if proto == E131 {
+		if len(packet) < E131_HEADER_SIZE || !bytes.Equal(packet[4:16], e131Identifier) {
+			t.Fatalf("not e1.31 packet % x", packet)
+		}
+		count := int(binary.BigEndian.Uint16(packet[123:])) - 1 // without start code
+		return receivedDmx{
+			universe: int(binary.BigEndian.Uint16(packet[113:])),
+			sequence: packet[111],
+			data:     packet[E131_HEADER_SIZE : E131_HEADER_SIZE+count],
+		}
+	}
+	if len(packet) < ARTNET_HEADER_SIZE || !bytes.Equal(packet[0:8], artnetIdentifier) {
+		t.Fatalf("not art-net packet % x", packet)
+	}
+	length := int(binary.BigEndian.Uint16(packet[16:]))
+	return receivedDmx{
+		universe: int(packet[15])<<8 | int(packet[14]),
+		sequence: packet[12],
+		data:     packet[ARTNET_HEADER_SIZE : ARTNET_HEADER_SIZE+length],
+	}
+}
+
+func TestDmxTransportSend(t *testing.T) {
+	tests := []struct {
+		name      string
+		proto     int
+		universe  int
+		sequences []byte // of two sends
+	}{
+		{"e131", E131, 7, []byte{0, 1}},
+		{"artnet", ARTNET, 0x1ff, []byte{1, 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			tr, err := newDmxTransport(conn.LocalAddr().String(), tt.proto, tt.universe, 4, 200)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tr.Close()
+
+			buf := make([]byte, 200*3)
+			for i := range buf {
+				buf[i] = byte(i)
+			}
+			for _, sequence := range tt.sequences {
+				if err := tr.Send(buf, 0); err != nil {
+					t.Fatal(err)
+				}
+				joined := []byte{}
+				for i := 0; i < 2; i++ { // 169 leds in first universe, 31 in second
+					packet := make([]byte, 1024)
+					conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+					n, err := conn.Read(packet)
+					if err != nil {
+						t.Fatal(err)
+					}
+					got := decodeDmx(t, tt.proto, packet[:n])
+					if got.universe != tt.universe+i {
+						t.Errorf("universe %d, want %d", got.universe, tt.universe+i)
+					}
+					if got.sequence != sequence {
+						t.Errorf("sequence %d, want %d", got.sequence, sequence)
+					}
+					data := got.data
+					if i == 0 {
+						if !bytes.Equal(data[:3], []byte{0, 0, 0}) {
+							t.Errorf("channels before start channel are % x", data[:3])
+						}
+						data = data[3:]
+					}
+					joined = append(joined, data...)
+				}
+				if len(joined) == len(buf)+1 && joined[len(buf)] == 0 { // art-net pads odd length
+					joined = joined[:len(buf)]
+				}
+				if !bytes.Equal(joined, buf) {
+					t.Errorf("received leds differ\n got % x\nwant % x", joined, buf)
+				}
+			}
+		})
+	}
+}
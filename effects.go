@@ -0,0 +1,362 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// names of effects
+const (
+	EFFECT_NONE    = "none"
+	EFFECT_RIPPLE  = "ripple"  // waves spreading from pressed keys to their neighbours
+	EFFECT_DECAY   = "decay"   // released notes fade out slowly
+	EFFECT_SPARKLE = "sparkle" // loud notes spark around
+	EFFECT_COMET   = "comet"   // pressed keys launch comets along the strip
+)
+
+// effects in order they are switched by the control key
+var effectNames = []string{EFFECT_NONE, EFFECT_RIPPLE, EFFECT_DECAY, EFFECT_SPARKLE, EFFECT_COMET}
+
+// Effect animates the leds on top of the notes
+// it is driven only by given times, so the same notes give the same frames
+type Effect interface {
+	Note(note byte, rgb RGB, velocity byte, at time.Time) // velocity is 0 when released
+	Render(frame Frame, now time.Time)                    // adds colors to the frame
+	Busy(now time.Time) bool                              // whether anything is still animated
+}
+
+// Frame is colors added to the keys
+type Frame struct {
+	First  int // midi value of the first key
+	Colors []RGB
+}
+
+func newFrame(first int, keys int) Frame {
+	return Frame{first, make([]RGB, keys)}
+}
+
+// Adds the color dimmed by level (0-1) to the key, keys out of the frame are ignored
+func (f Frame) Add(note int, rgb RGB, level float64) {
+	i := note - f.First
+	if i < 0 || i >= len(f.Colors) || level <= 0 {
+		return
+	}
+	f.Colors[i] = addColor(f.Colors[i], avgColor(BLACK, rgb, math.Min(level, 1)))
+}
+
+// Returns color added to the key, black for keys out of the frame
+func (f Frame) At(note int) RGB {
+	i := note - f.First
+	if i < 0 || i >= len(f.Colors) {
+		return BLACK
+	}
+	return f.Colors[i]
+}
+
+// Sums the colors, saturated at white
+func addColor(clr1 RGB, clr2 RGB) RGB {
+	for i := range clr1 {
+		clr1[i] = byte(math.Min(float64(clr1[i])+float64(clr2[i]), 255))
+	}
+	return clr1
+}
+
+// EffectParams are parameters of all effects, only the selected one is used
+type EffectParams struct {
+	Ripple  RippleParams  `json:"ripple"`
+	Decay   DecayParams   `json:"decay"`
+	Sparkle SparkleParams `json:"sparkle"`
+	Comet   CometParams   `json:"comet"`
+}
+
+type RippleParams struct {
+	Speed float64 `json:"speed"` // keys per second
+	Reach int     `json:"reach"` // keys to each side
+}
+
+type DecayParams struct {
+	Duration float64 `json:"duration"` // seconds until released note is gone
+}
+
+type SparkleParams struct {
+	Threshold byte    `json:"threshold"` // least velocity of sparking note
+	Count     int     `json:"count"`     // sparks per note
+	Spread    int     `json:"spread"`    // keys to each side
+	Duration  float64 `json:"duration"`  // seconds of single spark
+	Seed      int64   `json:"seed"`      // of spark positions
+}
+
+type CometParams struct {
+	Speed float64 `json:"speed"` // keys per second
+	Tail  int     `json:"tail"`  // keys
+	Down  bool    `json:"down"`  // flies towards the lowest key
+}
+
+func defaultEffectParams() EffectParams {
+	return EffectParams{
+		Ripple:  RippleParams{Speed: 24, Reach: 12},
+		Decay:   DecayParams{Duration: 1.5},
+		Sparkle: SparkleParams{Threshold: 96, Count: 4, Spread: 6, Duration: 0.4, Seed: 1},
+		Comet:   CometParams{Speed: 40, Tail: 6},
+	}
+}
+
+// limits of effect params, so a single note can't flood the renderer
+const (
+	EFFECT_MIN_SPEED    = 1   // keys per second
+	EFFECT_MAX_SPEED    = 500 // keys per second
+	EFFECT_MAX_KEYS     = 88  // of reach, spread or tail
+	EFFECT_MAX_DURATION = 10  // seconds
+	EFFECT_MAX_SPARKS   = 32  // per note
+)
+
+func (p EffectParams) validate() error {
+	speedOk := func(speed float64) bool {
+		return speed >= EFFECT_MIN_SPEED && speed <= EFFECT_MAX_SPEED
+	}
+	keysOk := func(keys int, min int) bool {
+		return keys >= min && keys <= EFFECT_MAX_KEYS
+	}
+	durationOk := func(duration float64) bool {
+		return duration > 0 && duration <= EFFECT_MAX_DURATION
+	}
+	switch {
+	case !speedOk(p.Ripple.Speed) || !keysOk(p.Ripple.Reach, 1):
+		return fmt.Errorf("invalid ripple speed or reach")
+	case !durationOk(p.Decay.Duration):
+		return fmt.Errorf("invalid decay duration")
+	case p.Sparkle.Count < 0 || p.Sparkle.Count > EFFECT_MAX_SPARKS ||
+		!keysOk(p.Sparkle.Spread, 0) || !durationOk(p.Sparkle.Duration):
+		return fmt.Errorf("invalid sparkle count, spread or duration")
+	case !speedOk(p.Comet.Speed) || !keysOk(p.Comet.Tail, 0):
+		return fmt.Errorf("invalid comet speed or tail")
+	}
+	return nil
+}
+
+// makes effect for keys from first (midi value) to first+keys-1
+var effectFactories = map[string]func(p EffectParams, first int, keys int) Effect{
+	EFFECT_RIPPLE: func(p EffectParams, first int, keys int) Effect {
+		return &rippleEffect{params: p.Ripple}
+	},
+	EFFECT_DECAY: func(p EffectParams, first int, keys int) Effect {
+		return &decayEffect{params: p.Decay}
+	},
+	EFFECT_SPARKLE: func(p EffectParams, first int, keys int) Effect {
+		return &sparkleEffect{params: p.Sparkle, rand: rand.New(rand.NewSource(p.Sparkle.Seed))}
+	},
+	EFFECT_COMET: func(p EffectParams, first int, keys int) Effect {
+		return &cometEffect{params: p.Comet, first: first, last: first + keys - 1}
+	},
+}
+
+// Returns the effect of the name, nil for none or unknown
+func newEffect(name string, p EffectParams, first int, keys int) Effect {
+	if factory, ok := effectFactories[name]; ok {
+		return factory(p, first, keys)
+	}
+	return nil
+}
+
+func isEffect(name string) bool {
+	_, ok := effectFactories[name]
+	return ok || name == EFFECT_NONE
+}
+
+// seconds from at till now
+func since(at time.Time, now time.Time) float64 {
+	return now.Sub(at).Seconds()
+}
+
+// spark is a single animated thing started by a note
+type spark struct {
+	note  int
+	rgb   RGB
+	level float64 // 0-1 by velocity
+	at    time.Time
+	phase float64 // of twinkling
+}
+
+// whether any spark is younger than duration
+func anyAlive(sparks []spark, now time.Time, duration float64) bool {
+	for _, s := range sparks {
+		if since(s.at, now) < duration {
+			return true
+		}
+	}
+	return false
+}
+
+// removes sparks older than duration
+func pruneSparks(sparks []spark, now time.Time, duration float64) []spark {
+	alive := sparks[:0]
+	for _, s := range sparks {
+		if since(s.at, now) < duration {
+			alive = append(alive, s)
+		}
+	}
+	return alive
+}
+
+type rippleEffect struct {
+	params RippleParams
+	waves  []spark
+}
+
+func (e *rippleEffect) duration() float64 {
+	return float64(e.params.Reach) / e.params.Speed
+}
+
+func (e *rippleEffect) Note(note byte, rgb RGB, velocity byte, at time.Time) {
+	if velocity > 0 {
+		e.waves = append(e.waves, spark{note: int(note), rgb: rgb, level: fromVal(velocity), at: at})
+	}
+}
+
+func (e *rippleEffect) Render(frame Frame, now time.Time) {
+	e.waves = pruneSparks(e.waves, now, e.duration())
+	for _, w := range e.waves {
+		dist := since(w.at, now) * e.params.Speed // of the wave front in keys
+		key := int(dist)
+		if key < 1 {
+			continue
+		}
+		level := w.level * (1 - dist/float64(e.params.Reach))
+		frame.Add(w.note-key, w.rgb, level)
+		frame.Add(w.note+key, w.rgb, level)
+	}
+}
+
+func (e *rippleEffect) Busy(now time.Time) bool {
+	return anyAlive(e.waves, now, e.duration())
+}
+
+type decayEffect struct {
+	params DecayParams
+	tails  []spark
+	rgbs   map[byte]RGB // of pressed notes
+}
+
+func (e *decayEffect) Note(note byte, rgb RGB, velocity byte, at time.Time) {
+	if e.rgbs == nil {
+		e.rgbs = make(map[byte]RGB)
+	}
+	if velocity > 0 {
+		e.rgbs[note] = rgb
+		return
+	}
+	if rgb, ok := e.rgbs[note]; ok {
+		e.tails = append(e.tails, spark{note: int(note), rgb: rgb, level: 1, at: at})
+		delete(e.rgbs, note)
+	}
+}
+
+func (e *decayEffect) Render(frame Frame, now time.Time) {
+	e.tails = pruneSparks(e.tails, now, e.params.Duration)
+	for _, t := range e.tails {
+		frame.Add(t.note, t.rgb, 1-since(t.at, now)/e.params.Duration)
+	}
+}
+
+func (e *decayEffect) Busy(now time.Time) bool {
+	return anyAlive(e.tails, now, e.params.Duration)
+}
+
+type sparkleEffect struct {
+	params SparkleParams
+	rand   *rand.Rand // positions are drawn when note is pressed, not when rendered
+	sparks []spark
+}
+
+func (e *sparkleEffect) Note(note byte, rgb RGB, velocity byte, at time.Time) {
+	if velocity == 0 || velocity < e.params.Threshold {
+		return
+	}
+	for i := 0; i < e.params.Count; i++ {
+		offset := e.rand.Intn(2*e.params.Spread+1) - e.params.Spread
+		delay := time.Duration(e.rand.Float64() * e.params.Duration / 2 * float64(time.Second))
+		e.sparks = append(e.sparks, spark{
+			note:  int(note) + offset,
+			rgb:   addColor(rgb, dimmedColor(WHITE_COLD)), // a bit whiter than the note
+			level: fromVal(velocity),
+			at:    at.Add(delay),
+			phase: e.rand.Float64() * 2 * math.Pi,
+		})
+	}
+}
+
+func (e *sparkleEffect) Render(frame Frame, now time.Time) {
+	e.sparks = pruneSparks(e.sparks, now, e.params.Duration)
+	for _, s := range e.sparks {
+		t := since(s.at, now) / e.params.Duration
+		if t < 0 { // delayed
+			continue
+		}
+		twinkle := 0.5 + 0.5*math.Cos(s.phase+t*4*math.Pi)
+		frame.Add(s.note, s.rgb, s.level*(1-t)*twinkle)
+	}
+}
+
+func (e *sparkleEffect) Busy(now time.Time) bool {
+	return anyAlive(e.sparks, now, e.params.Duration)
+}
+
+type cometEffect struct {
+	params CometParams
+	first  int // keys the comets fly over
+	last   int
+	comets []spark
+}
+
+// seconds until the comet from the note leaves the keys
+func (e *cometEffect) flight(note int) float64 {
+	keys := e.last - note
+	if e.params.Down {
+		keys = note - e.first
+	}
+	return float64(keys+e.params.Tail+1) / e.params.Speed
+}
+
+func (e *cometEffect) Note(note byte, rgb RGB, velocity byte, at time.Time) {
+	if velocity > 0 {
+		e.comets = append(e.comets, spark{note: int(note), rgb: rgb, level: fromVal(velocity), at: at})
+	}
+}
+
+func (e *cometEffect) alive(now time.Time) []spark {
+	alive := e.comets[:0]
+	for _, c := range e.comets {
+		if since(c.at, now) < e.flight(c.note) {
+			alive = append(alive, c)
+		}
+	}
+	return alive
+}
+
+func (e *cometEffect) Render(frame Frame, now time.Time) {
+	e.comets = e.alive(now)
+	dir := 1
+	if e.params.Down {
+		dir = -1
+	}
+	for _, c := range e.comets {
+		head := int(since(c.at, now) * e.params.Speed)
+		for i := 0; i <= e.params.Tail; i++ {
+			if head-i < 1 { // not on the key itself
+				break
+			}
+			frame.Add(c.note+dir*(head-i), c.rgb, c.level*(1-float64(i)/float64(e.params.Tail+1)))
+		}
+	}
+}
+
+func (e *cometEffect) Busy(now time.Time) bool {
+	for _, c := range e.comets {
+		if since(c.at, now) < e.flight(c.note) {
+			return true
+		}
+	}
+	return false
+}
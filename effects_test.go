@@ -0,0 +1,240 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+var (
+	testT0     = time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	testOrange = RGB{200, 100, 0}
+)
+
+const (
+	testFirst = 48 // frame covers keys 48-72
+	testKeys  = 25
+)
+
+// renders the effect into empty frame and returns its non-black keys
+func litKeys(e Effect, now time.Time) map[int]RGB {
+	frame := newFrame(testFirst, testKeys)
+	e.Render(frame, now)
+	lit := map[int]RGB{}
+	for note := testFirst; note < testFirst+testKeys; note++ {
+		if clr := frame.At(note); clr != BLACK {
+			lit[note] = clr
+		}
+	}
+	return lit
+}
+
+func after(d time.Duration) time.Time {
+	return testT0.Add(d)
+}
+
+func TestFrame(t *testing.T) {
+	frame := newFrame(testFirst, testKeys)
+	frame.Add(60, RGB{200, 100, 0}, 0.5)
+	frame.Add(60, RGB{200, 200, 200}, 1)
+	frame.Add(testFirst-1, testOrange, 1)        // out of the frame
+	frame.Add(testFirst+testKeys, testOrange, 1) // out of the frame
+	if got, want := frame.At(60), (RGB{255, 250, 200}); got != want {
+		t.Errorf("added colors %v, want %v", got, want)
+	}
+	if got := frame.At(testFirst - 1); got != BLACK {
+		t.Errorf("key out of the frame is %v, want black", got)
+	}
+}
+
+func TestRippleEffect(t *testing.T) {
+	tests := []struct {
+		name string
+		at   time.Duration
+		want map[int]RGB
+	}{
+		{"front still on the key", 50 * time.Millisecond, map[int]RGB{}},
+		{"front at first neighbours", 100 * time.Millisecond, map[int]RGB{59: {160, 80, 0}, 61: {160, 80, 0}}},
+		{"half way is half level", 250 * time.Millisecond, map[int]RGB{58: {100, 50, 0}, 62: {100, 50, 0}}},
+		{"gone after reach", 500 * time.Millisecond, map[int]RGB{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := defaultEffectParams()
+			p.Ripple = RippleParams{Speed: 10, Reach: 5}
+			e := newEffect(EFFECT_RIPPLE, p, testFirst, testKeys)
+			e.Note(60, testOrange, 127, testT0)
+			if got := litKeys(e, after(tt.at)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("lit %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecayEffect(t *testing.T) {
+	tests := []struct {
+		name string
+		at   time.Duration
+		want map[int]RGB
+	}{
+		{"nothing while pressed", 500 * time.Millisecond, map[int]RGB{}},
+		{"full when released", time.Second, map[int]RGB{60: testOrange}},
+		{"fading", 1500 * time.Millisecond, map[int]RGB{60: {150, 75, 0}}},
+		{"gone after duration", 3 * time.Second, map[int]RGB{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := defaultEffectParams()
+			p.Decay.Duration = 2
+			e := newEffect(EFFECT_DECAY, p, testFirst, testKeys)
+			e.Note(60, testOrange, 100, testT0)
+			if tt.at >= time.Second {
+				e.Note(60, BLACK, 0, after(time.Second)) // color of release is not used
+			}
+			if got := litKeys(e, after(tt.at)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("lit %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSparkleEffect(t *testing.T) {
+	p := defaultEffectParams()
+	p.Sparkle = SparkleParams{Threshold: 64, Count: 8, Spread: 3, Duration: 1, Seed: 7}
+	play := func(seed int64) []map[int]RGB {
+		p := p
+		p.Sparkle.Seed = seed
+		e := newEffect(EFFECT_SPARKLE, p, testFirst, testKeys)
+		e.Note(60, testOrange, 100, testT0)
+		e.Note(64, testOrange, 30, testT0) // too soft to spark
+		frames := []map[int]RGB{}
+		for at := time.Duration(0); at <= 1500*time.Millisecond; at += 100 * time.Millisecond {
+			frames = append(frames, litKeys(e, after(at)))
+		}
+		return frames
+	}
+
+	frames := play(7)
+	if again := play(7); !reflect.DeepEqual(frames, again) {
+		t.Errorf("same seed gives different frames\n%v\n%v", frames, again)
+	}
+	if other := play(8); reflect.DeepEqual(frames, other) {
+		t.Errorf("different seed gives the same frames")
+	}
+	sparked := false
+	for _, lit := range frames {
+		for note := range lit {
+			sparked = true
+			if note < 60-3 || note > 60+3 {
+				t.Errorf("spark at %d out of spread", note)
+			}
+		}
+	}
+	if !sparked {
+		t.Errorf("no sparks")
+	}
+	if last := frames[len(frames)-1]; len(last) > 0 { // 1.5s is over delay and duration
+		t.Errorf("sparks %v left after duration", last)
+	}
+}
+
+func TestCometEffect(t *testing.T) {
+	tests := []struct {
+		name string
+		down bool
+		at   time.Duration
+		want map[int]RGB
+	}{
+		{"launched up", false, 200 * time.Millisecond, map[int]RGB{64: {200, 0, 0}, 63: {150, 0, 0}}},
+		{"launched down", true, 200 * time.Millisecond, map[int]RGB{60: {200, 0, 0}, 61: {150, 0, 0}}},
+		{"whole tail up", false, 500 * time.Millisecond, map[int]RGB{
+			67: {200, 0, 0}, 66: {150, 0, 0}, 65: {100, 0, 0}, 64: {50, 0, 0},
+		}},
+		{"whole tail down", true, 500 * time.Millisecond, map[int]RGB{
+			57: {200, 0, 0}, 58: {150, 0, 0}, 59: {100, 0, 0}, 60: {50, 0, 0},
+		}},
+		{"head left the keys", false, 1200 * time.Millisecond, map[int]RGB{
+			72: {100, 0, 0}, 71: {50, 0, 0},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := defaultEffectParams()
+			p.Comet = CometParams{Speed: 10, Tail: 3, Down: tt.down}
+			e := newEffect(EFFECT_COMET, p, testFirst, testKeys)
+			e.Note(62, RGB{200, 0, 0}, 127, testT0)
+			if got := litKeys(e, after(tt.at)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("lit %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEffectBusy(t *testing.T) {
+	p := defaultEffectParams()
+	p.Ripple = RippleParams{Speed: 10, Reach: 5}                // 0.5s
+	p.Decay.Duration = 2                                        // after release at 1s
+	p.Sparkle = SparkleParams{Count: 4, Spread: 2, Duration: 1} // delayed up to 0.5s
+	p.Comet = CometParams{Speed: 10, Tail: 3}                   // 62 up to 72 and tail is 1.4s
+	tests := []struct {
+		effect string
+		at     time.Duration
+		busy   bool
+	}{
+		{EFFECT_RIPPLE, 400 * time.Millisecond, true},
+		{EFFECT_RIPPLE, 600 * time.Millisecond, false},
+		{EFFECT_DECAY, 2900 * time.Millisecond, true},
+		{EFFECT_DECAY, 3100 * time.Millisecond, false},
+		{EFFECT_SPARKLE, 900 * time.Millisecond, true},
+		{EFFECT_SPARKLE, 1600 * time.Millisecond, false},
+		{EFFECT_COMET, 1300 * time.Millisecond, true},
+		{EFFECT_COMET, 1500 * time.Millisecond, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.effect+" "+tt.at.String(), func(t *testing.T) {
+			e := newEffect(tt.effect, p, testFirst, testKeys)
+			if e.Busy(testT0) {
+				t.Errorf("busy before any note")
+			}
+			e.Note(62, testOrange, 127, testT0)
+			e.Note(62, BLACK, 0, after(time.Second))
+			if got := e.Busy(after(tt.at)); got != tt.busy {
+				t.Errorf("busy %v after %v, want %v", got, tt.at, tt.busy)
+			}
+		})
+	}
+}
+
+func TestEffectParamsValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(p *EffectParams)
+		valid  bool
+	}{
+		{"defaults", func(p *EffectParams) {}, true},
+		{"ripple too slow", func(p *EffectParams) { p.Ripple.Speed = 1e-9 }, false},
+		{"ripple too fast", func(p *EffectParams) { p.Ripple.Speed = 1e9 }, false},
+		{"ripple reach over keyboard", func(p *EffectParams) { p.Ripple.Reach = 1000 }, false},
+		{"endless decay", func(p *EffectParams) { p.Decay.Duration = 1e9 }, false},
+		{"too many sparks", func(p *EffectParams) { p.Sparkle.Count = 1e9 }, false},
+		{"no sparks", func(p *EffectParams) { p.Sparkle.Count = 0 }, true},
+		{"negative spread", func(p *EffectParams) { p.Sparkle.Spread = -1 }, false},
+		{"zero spark duration", func(p *EffectParams) { p.Sparkle.Duration = 0 }, false},
+		{"comet tail over keyboard", func(p *EffectParams) { p.Comet.Tail = 89 }, false},
+		{"comet too slow", func(p *EffectParams) { p.Comet.Speed = 0.5 }, false},
+		{"limits", func(p *EffectParams) {
+			p.Ripple = RippleParams{Speed: EFFECT_MAX_SPEED, Reach: EFFECT_MAX_KEYS}
+			p.Sparkle.Count = EFFECT_MAX_SPARKS
+			p.Decay.Duration = EFFECT_MAX_DURATION
+		}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := defaultEffectParams()
+			tt.change(&p)
+			if err := p.validate(); (err == nil) != tt.valid {
+				t.Errorf("validate() = %v, want valid %v", err, tt.valid)
+			}
+		})
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"gitlab.com/gomidi/midi"
+	"gitlab.com/gomidi/midi/midimessage/channel"
+)
+
+// Event is a single midi channel message
+type Event struct {
+	Cmd     int       // one of CMD_* constants
+	Channel byte      // 0-15
+	Key     byte      // note, controller or program number
+	Value   byte      // velocity, controller value or pressure
+	Bend    int       // pitch bend -8192..8191
+	Time    time.Time // when the event was received
+	Source  string    // where the event comes from, one of SRC_* constants
+	User    byte      // pianco user id of remote event
+}
+
+// Sources of events
+const (
+	SRC_INPUT    = "input"    // live midi input
+	SRC_PLAYBACK = "playback" // replayed recording
+	SRC_REMOTE   = "remote"   // received from pianco relay
+)
+
+// Categories of events used by filters
+const (
+	EV_NOTE       = "note"       // note on and off
+	EV_SUSTAIN    = "sustain"    // sustain pedal
+	EV_SOSTENUTO  = "sostenuto"  // sostenuto pedal
+	EV_SOFT       = "soft"       // soft pedal
+	EV_CONTROL    = "control"    // any other control change
+	EV_PROGRAM    = "program"    // program change
+	EV_BEND       = "bend"       // pitch bend
+	EV_AFTERTOUCH = "aftertouch" // polyphonic and channel pressure
+)
+
+var eventCategories = []string{
+	EV_NOTE, EV_SUSTAIN, EV_SOSTENUTO, EV_SOFT, EV_CONTROL, EV_PROGRAM, EV_BEND, EV_AFTERTOUCH,
+}
+
+// Parses raw midi message, returns false for non channel messages
+func eventFromRaw(raw []byte) (Event, bool) {
+	if len(raw) < 2 || raw[0] < 0x80 || raw[0] >= 0xF0 {
+		return Event{}, false
+	}
+	ev := Event{
+		Cmd:     fromCmd(raw[0]),
+		Channel: chanFromCmd(raw[0]),
+		Time:    time.Now(),
+	}
+	switch ev.Cmd {
+	case CMD_PROGRAM_CHANGE:
+		ev.Key = raw[1]
+	case CMD_CHANNEL_PRESSURE:
+		ev.Value = raw[1]
+	case CMD_PITCH_BEND:
+		if len(raw) < 3 {
+			return Event{}, false
+		}
+		ev.Bend = (int(raw[2])<<7 | int(raw[1])) - 8192
+	default:
+		if len(raw) < 3 {
+			return Event{}, false
+		}
+		ev.Key = raw[1]
+		ev.Value = raw[2]
+	}
+	return ev, true
+}
+
+// Encodes the event as raw midi message
+func (ev Event) Raw() []byte {
+	status := (1<<3|byte(ev.Cmd))<<4 | ev.Channel&0x0F
+	switch ev.Cmd {
+	case CMD_PROGRAM_CHANGE:
+		return []byte{status, ev.Key & 0x7F}
+	case CMD_CHANNEL_PRESSURE:
+		return []byte{status, ev.Value & 0x7F}
+	case CMD_PITCH_BEND:
+		bend := ev.Bend + 8192
+		return []byte{status, byte(bend & 0x7F), byte(bend >> 7 & 0x7F)}
+	default:
+		return []byte{status, ev.Key & 0x7F, ev.Value & 0x7F}
+	}
+}
+
+// Converts the event to gomidi message
+func (ev Event) Message() midi.Message {
+	ch := channel.Channel(ev.Channel & 0x0F)
+	switch ev.Cmd {
+	case CMD_NOTE_ON:
+		return ch.NoteOn(ev.Key, ev.Value)
+	case CMD_AFTERTOUCH:
+		return ch.PolyAftertouch(ev.Key, ev.Value)
+	case CMD_CONTROL_CHANGE:
+		return ch.ControlChange(ev.Key, ev.Value)
+	case CMD_PROGRAM_CHANGE:
+		return ch.ProgramChange(ev.Key)
+	case CMD_CHANNEL_PRESSURE:
+		return ch.Aftertouch(ev.Value)
+	case CMD_PITCH_BEND:
+		return ch.Pitchbend(int16(ev.Bend))
+	default:
+		return ch.NoteOffVelocity(ev.Key, ev.Value)
+	}
+}
+
+// Whether the event ends a note or releases a pedal
+// such events are never dropped, as losing them leaves notes stuck
+func (ev Event) IsRelease() bool {
+	switch {
+	case ev.Cmd == CMD_NOTE_OFF, ev.Cmd == CMD_NOTE_ON && ev.Value == 0:
+		return true
+	case ev.Cmd == CMD_CONTROL_CHANGE && ev.Value == 0:
+		return ev.Key == CC_SUTAIN || ev.Key == CC_SOSTENUTO || ev.Key == CC_SOFT
+	}
+	return false
+}
+
+// Returns filter category of the event
+func (ev Event) Category() string {
+	switch ev.Cmd {
+	case CMD_NOTE_ON, CMD_NOTE_OFF:
+		return EV_NOTE
+	case CMD_CONTROL_CHANGE:
+		switch ev.Key {
+		case CC_SUTAIN:
+			return EV_SUSTAIN
+		case CC_SOSTENUTO:
+			return EV_SOSTENUTO
+		case CC_SOFT:
+			return EV_SOFT
+		}
+		return EV_CONTROL
+	case CMD_PROGRAM_CHANGE:
+		return EV_PROGRAM
+	case CMD_PITCH_BEND:
+		return EV_BEND
+	default:
+		return EV_AFTERTOUCH
+	}
+}
+
+func (ev Event) String() string {
+	return fmt.Sprintf("%s cmd=%d ch=%d key=%d val=%d bend=%d", ev.Category(), ev.Cmd, ev.Channel, ev.Key, ev.Value, ev.Bend)
+}
+
+// will translate 'note on' with zero velocity as 'note off'
+// and sets channel to the configured one
+func normalizeEvent(ev Event) Event {
+	if ev.Cmd == CMD_NOTE_ON && ev.Value == 0 {
+		ev.Cmd = CMD_NOTE_OFF
+	}
+	ev.Channel = byte(config.Midi.Channel) // force configured channel
+	return ev
+}
+
+// EventFilter is a set of event categories passed to an output
+// empty filter passes everything
+type EventFilter map[string]bool
+
+func newEventFilter(categories []string) (EventFilter, error) {
+	filter := EventFilter{}
+	for _, c := range categories {
+		known := false
+		for _, k := range eventCategories {
+			known = known || k == c
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown event category %q", c)
+		}
+		filter[c] = true
+	}
+	return filter, nil
+}
+
+func (f EventFilter) Pass(ev Event) bool {
+	return len(f) == 0 || f[ev.Category()]
+}
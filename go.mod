@@ -3,9 +3,11 @@ module github.com/drahoslove/gopiano
 go 1.14
 
 require (
+	github.com/fsnotify/fsnotify v1.6.0
 	github.com/gorilla/handlers v1.5.1
 	github.com/gorilla/mux v1.8.1
 	github.com/gorilla/websocket v1.4.2
 	gitlab.com/gomidi/midi v1.21.0
 	gitlab.com/gomidi/rtmididrv v0.10.1
+	golang.org/x/sys v0.7.0 // indirect
 )
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+// Group is pianco relay group we are member of
+type Group struct {
+	ID      byte `json:"id"`
+	Send    bool `json:"send"`    // our notes are sent to the group
+	Receive bool `json:"receive"` // notes of the group are played here
+}
+
+// Groups keeps our pianco identity and group membership
+type Groups struct {
+	mu     sync.RWMutex
+	uid    byte
+	groups map[byte]Group
+}
+
+func newGroups(cfg PiancoConfig) *Groups {
+	g := &Groups{
+		uid:    byte(cfg.UID),
+		groups: make(map[byte]Group),
+	}
+	for _, group := range cfg.Groups {
+		g.groups[group.ID] = group
+	}
+	return g
+}
+
+func (g *Groups) UID() byte {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return g.uid
+}
+
+func (g *Groups) SetUID(uid byte) {
+	g.mu.Lock()
+	g.uid = uid
+	g.mu.Unlock()
+}
+
+// Returns joined groups ordered by id
+func (g *Groups) List() []Group {
+	g.mu.RLock()
+	list := make([]Group, 0, len(g.groups))
+	for _, group := range g.groups {
+		list = append(list, group)
+	}
+	g.mu.RUnlock()
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].ID < list[j].ID
+	})
+	return list
+}
+
+// Joins the group or changes its settings
+func (g *Groups) Join(group Group) {
+	g.mu.Lock()
+	g.groups[group.ID] = group
+	g.mu.Unlock()
+}
+
+// Leaves the group, returns false if not joined
+func (g *Groups) Leave(gid byte) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	_, ok := g.groups[gid]
+	delete(g.groups, gid)
+	return ok
+}
+
+// Encodes the event as pianco message for every group we send to
+func (g *Groups) Encode(ev Event) [][]byte {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	msgs := [][]byte{}
+	for gid, group := range g.groups {
+		if group.Send {
+			msgs = append(msgs, encodePianco(gid, g.uid, ev))
+		}
+	}
+	return msgs
+}
+
+// Returns whether message of the group and user should be played here
+// our own messages are not
+func (g *Groups) Accepts(gid, uid byte) bool {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return g.groups[gid].Receive && uid != g.uid
+}
+
+// Parses id of group or user (0-255)
+func parseID(value string) (byte, error) {
+	id, err := strconv.ParseUint(value, 10, 8)
+	if err != nil {
+		return 0, fmt.Errorf("invalid id %q", value)
+	}
+	return byte(id), nil
+}
+
+// Registers http api for pianco identity and groups
+func handleGroups(r *mux.Router, groups *Groups) {
+	writeGroups := func(w http.ResponseWriter) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"uid":    groups.UID(),
+			"groups": groups.List(),
+		})
+	}
+
+	r.HandleFunc("/pianco/groups", func(w http.ResponseWriter, r *http.Request) {
+		setupResponse(&w, r)
+		writeGroups(w)
+	}).Methods(http.MethodGet)
+
+	// our user id, {"uid": 3}
+	r.HandleFunc("/pianco/uid", func(w http.ResponseWriter, r *http.Request) {
+		setupResponse(&w, r)
+		body := struct {
+			UID *int `json:"uid"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.UID == nil {
+			http.Error(w, "invalid body", http.StatusBadRequest)
+			return
+		}
+		if *body.UID < 0 || *body.UID > 255 {
+			http.Error(w, "uid out of range", http.StatusBadRequest)
+			return
+		}
+		groups.SetUID(byte(*body.UID))
+		writeGroups(w)
+	}).Methods(http.MethodPut)
+
+	// joins the group or changes its settings, {"send": true, "receive": true}
+	r.HandleFunc("/pianco/groups/{gid:[0-9]+}", func(w http.ResponseWriter, r *http.Request) {
+		setupResponse(&w, r)
+		gid, err := parseID(mux.Vars(r)["gid"])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		group := Group{Send: true, Receive: true}
+		if err := json.NewDecoder(r.Body).Decode(&group); err != nil && err != io.EOF { // empty body joins with defaults
+			http.Error(w, "invalid body", http.StatusBadRequest)
+			return
+		}
+		group.ID = gid
+		groups.Join(group)
+		writeGroups(w)
+	}).Methods(http.MethodPut)
+
+	r.HandleFunc("/pianco/groups/{gid:[0-9]+}", func(w http.ResponseWriter, r *http.Request) {
+		setupResponse(&w, r)
+		gid, err := parseID(mux.Vars(r)["gid"])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !groups.Leave(gid) {
+			http.Error(w, "not a member of the group", http.StatusNotFound)
+			return
+		}
+		writeGroups(w)
+	}).Methods(http.MethodDelete)
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const INDEX_FILE = "recordings.index"
+
+// version of the index schema, increment when IndexEntry changes
+// and add migration to migrateIndex
+const INDEX_VERSION = 4
+
+var errNotFound = errors.New("recording not found")
+
+// IndexEntry is a parsed mid file of the archive
+// size and modification time tell whether it has to be parsed again
+type IndexEntry struct {
+	Size      int64
+	ModTime   time.Time
+	Recording Recording
+	Analysis  *Analysis // nil until requested, then cached
+	Problem   string    // why the name couldn't be parsed, empty if it could
+}
+
+// ArchiveError describes file of the archive which could not be parsed well
+type ArchiveError struct {
+	Path    string    `json:"path"`
+	Error   string    `json:"error"`
+	Indexed bool      `json:"indexed"` // recording made from file contents, not from its name
+	size    int64     // size and modification time of the failed file
+	modTime time.Time // to skip it until changed
+}
+
+// indexFile is persisted form of the index
+type indexFile struct {
+	Version int
+	Entries map[string]IndexEntry // by slash separated path relative to archive dir
+}
+
+// Archive keeps index of recordings in the archive dir
+// the index is updated incrementally and persisted in the dir
+type Archive struct {
+	mu          sync.RWMutex
+	refreshMu   sync.Mutex // only one refresh at time
+	dir         string
+	entries     map[string]IndexEntry
+	failed      map[string]ArchiveError // files which can't be indexed at all
+	subscribers map[chan ArchiveEvent]bool
+	saveTimer   *time.Timer // pending save of cached analyses, nil if none
+}
+
+// types of archive events
+const (
+	ARCHIVE_ADDED   = "added"
+	ARCHIVE_CHANGED = "changed"
+	ARCHIVE_REMOVED = "removed"
+)
+
+// ArchiveEvent notifies about change of single recording
+type ArchiveEvent struct {
+	Type      string     `json:"type"`
+	Path      string     `json:"path"`
+	Recording *Recording `json:"recording,omitempty"`
+}
+
+// Opens archive and loads its index, broken or missing index starts empty
+func openArchive(dir string) *Archive {
+	a := &Archive{
+		dir:         dir,
+		entries:     make(map[string]IndexEntry),
+		failed:      make(map[string]ArchiveError),
+		subscribers: make(map[chan ArchiveEvent]bool),
+	}
+	entries, err := loadIndex(filepath.Join(dir, INDEX_FILE))
+	if err != nil {
+		log.Println("Index not loaded, rebuilding:", err)
+	} else {
+		a.entries = entries
+	}
+	return a
+}
+
+func loadIndex(indexPath string) (map[string]IndexEntry, error) {
+	file, err := os.Open(indexPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open index: %s", err)
+	}
+	defer file.Close()
+	index := indexFile{}
+	if err := gob.NewDecoder(file).Decode(&index); err != nil {
+		return nil, fmt.Errorf("failed to decode index: %s", err)
+	}
+	return migrateIndex(index)
+}
+
+// Converts index of older schema to the current one
+func migrateIndex(index indexFile) (map[string]IndexEntry, error) {
+	switch {
+	case index.Version == INDEX_VERSION:
+		return index.Entries, nil
+	case index.Version == 1: // no ids yet, analysis and problems are made on demand
+		for rel, entry := range index.Entries {
+			entry.Recording.ID = recordingID(rel)
+			index.Entries[rel] = entry
+		}
+		return index.Entries, nil
+	default:
+		return nil, fmt.Errorf("unsupported index version %d", index.Version)
+	}
+}
+
+// Writes the index to temp file and renames it, so it is never half written
+func saveIndex(indexPath string, entries map[string]IndexEntry) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(indexPath), ".index-*")
+	if err != nil {
+		return fmt.Errorf("failed to create index: %s", err)
+	}
+	defer os.Remove(tmp.Name())
+	err = gob.NewEncoder(tmp).Encode(indexFile{INDEX_VERSION, entries})
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to encode index: %s", err)
+	}
+	if err := os.Rename(tmp.Name(), indexPath); err != nil {
+		return fmt.Errorf("failed to save index: %s", err)
+	}
+	return nil
+}
+
+// Returns id of recording given by slash separated path relative to archive dir
+// it stays the same as long as the file is not moved
+func recordingID(rel string) string {
+	sum := sha1.Sum([]byte(rel))
+	return hex.EncodeToString(sum[:6])
+}
+
+// Parses single mid file of the archive
+// recordings with unusual names are made from the file contents and mtime
+func indexEntry(pathname, rel string, info fs.FileInfo) (IndexEntry, error) {
+	problem := ""
+	rec, complete, err := recordingFromName(pathname)
+	if !complete {
+		fromSMF, smfErr := recordingFromSMF(pathname, info.ModTime())
+		if smfErr != nil {
+			return IndexEntry{}, smfErr
+		}
+		if err != nil { // not even time in the name
+			problem = err.Error() + ", time taken from file modification"
+			rec.Time = fromSMF.Time
+		} else {
+			problem = "no notes and seconds in file name, counted from file contents"
+		}
+		rec.Duration = fromSMF.Duration
+		rec.Notes = fromSMF.Notes
+	}
+	rec.ID = recordingID(rel)
+	if err := rec.load88(pathname); err != nil {
+		return IndexEntry{}, err
+	}
+	return IndexEntry{
+		Size:      info.Size(),
+		ModTime:   info.ModTime(),
+		Recording: rec,
+		Problem:   problem,
+	}, nil
+}
+
+// Walks the archive dir, parses new and changed files, forgets deleted ones
+// and saves the index if anything changed
+// returns relative paths of the changes
+func (a *Archive) Refresh() (added, changed, removed []string, err error) {
+	a.refreshMu.Lock()
+	defer a.refreshMu.Unlock()
+
+	a.mu.RLock()
+	old := a.entries
+	oldFailed := a.failed
+	a.mu.RUnlock()
+
+	entries := make(map[string]IndexEntry, len(old))
+	failed := make(map[string]ArchiveError)
+	err = filepath.WalkDir(a.dir, func(pathname string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if pathname == a.dir {
+				return err
+			}
+			log.Println("Can't walk archive", err)
+			return nil
+		}
+		if d.IsDir() || filepath.Ext(pathname) != ".mid" { // skip dirs and non midi files
+			return nil
+		}
+		rel, err := filepath.Rel(a.dir, pathname)
+		if err != nil {
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+		info, err := d.Info()
+		if err != nil { // deleted meanwhile
+			return nil
+		}
+		entry, ok := old[rel]
+		if ok && entry.Size == info.Size() && entry.ModTime.Equal(info.ModTime()) {
+			entries[rel] = entry
+			return nil
+		}
+		if f, ok := oldFailed[rel]; ok && f.size == info.Size() && f.modTime.Equal(info.ModTime()) {
+			failed[rel] = f // don't try again until changed
+			return nil
+		}
+		entry, err = indexEntry(pathname, rel, info)
+		if err != nil {
+			log.Println("Can't index recording", rel, err)
+			failed[rel] = ArchiveError{rel, err.Error(), false, info.Size(), info.ModTime()}
+			return nil
+		}
+		if entry.Problem != "" {
+			log.Println("Recording indexed with problem", rel, entry.Problem)
+		}
+		entries[rel] = entry
+		if ok {
+			changed = append(changed, rel)
+		} else {
+			added = append(added, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to walk archive: %s", err)
+	}
+	for rel := range old {
+		if _, ok := entries[rel]; !ok {
+			removed = append(removed, rel)
+		}
+	}
+	a.mu.Lock()
+	a.failed = failed
+	a.mu.Unlock()
+	if len(added)+len(changed)+len(removed) == 0 {
+		return
+	}
+
+	a.mu.Lock()
+	a.entries = entries
+	if a.saveTimer != nil { // analyses are saved now
+		a.saveTimer.Stop()
+		a.saveTimer = nil
+	}
+	a.mu.Unlock()
+	if err := saveIndex(filepath.Join(a.dir, INDEX_FILE), entries); err != nil {
+		log.Println("Can't save index", err)
+	}
+
+	for _, rel := range added {
+		rec := entries[rel].Recording
+		a.publish(ArchiveEvent{ARCHIVE_ADDED, rel, &rec})
+	}
+	for _, rel := range changed {
+		rec := entries[rel].Recording
+		a.publish(ArchiveEvent{ARCHIVE_CHANGED, rel, &rec})
+	}
+	for _, rel := range removed {
+		a.publish(ArchiveEvent{ARCHIVE_REMOVED, rel, nil})
+	}
+	return
+}
+
+// Returns channel of archive changes and function to unsubscribe
+func (a *Archive) Subscribe() (chan ArchiveEvent, func()) {
+	events := make(chan ArchiveEvent, 16)
+	a.mu.Lock()
+	a.subscribers[events] = true
+	a.mu.Unlock()
+	return events, func() {
+		a.mu.Lock()
+		delete(a.subscribers, events)
+		a.mu.Unlock()
+	}
+}
+
+// sends the event to all subscribers, slow subscribers miss it
+func (a *Archive) publish(ev ArchiveEvent) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	for events := range a.subscribers {
+		select {
+		case events <- ev:
+		default:
+			log.Println("Archive event dropped for slow subscriber", ev.Path)
+		}
+	}
+}
+
+// Returns path and entry of recording by its id
+func (a *Archive) find(id string) (string, IndexEntry, bool) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	for rel, entry := range a.entries {
+		if entry.Recording.ID == id {
+			return rel, entry, true
+		}
+	}
+	return "", IndexEntry{}, false
+}
+
+// Returns recording by its id and its path relative to archive dir
+func (a *Archive) Get(id string) (Recording, string, error) {
+	rel, entry, ok := a.find(id)
+	if !ok {
+		return Recording{}, "", errNotFound
+	}
+	return entry.Recording, rel, nil
+}
+
+// Returns absolute path of the file given by slash separated relative path
+func (a *Archive) Path(rel string) string {
+	return filepath.Join(a.dir, filepath.FromSlash(rel))
+}
+
+// Returns files which could not be indexed or were indexed from their contents
+func (a *Archive) Errors() []ArchiveError {
+	a.mu.RLock()
+	errs := []ArchiveError{}
+	for _, f := range a.failed {
+		errs = append(errs, f)
+	}
+	for rel, entry := range a.entries {
+		if entry.Problem != "" {
+			errs = append(errs, ArchiveError{Path: rel, Error: entry.Problem, Indexed: true})
+		}
+	}
+	a.mu.RUnlock()
+	sort.Slice(errs, func(i, j int) bool {
+		return errs[i].Path < errs[j].Path
+	})
+	return errs
+}
+
+// Returns all recordings ordered by time
+func (a *Archive) Recordings() Recordings {
+	a.mu.RLock()
+	recordings := make(Recordings, 0, len(a.entries))
+	for _, entry := range a.entries {
+		recordings = append(recordings, entry.Recording)
+	}
+	a.mu.RUnlock()
+	sort.SliceStable(recordings, func(i, j int) bool {
+		return recordings[i].Time.Before(recordings[j].Time)
+	})
+	return recordings
+}
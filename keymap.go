@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+// LedRange is a span of consecutive leds lit by single key
+type LedRange struct {
+	First int `json:"first"` // index of first led on the strip
+	Count int `json:"count"` // number of leds
+}
+
+// KeyMap is a calibration table of leds for individual keys (notes)
+// Keys missing in the table use the uniform layout of Leds
+// It is shared by http handlers and the wled loop, so all access is locked
+type KeyMap struct {
+	mu          sync.RWMutex
+	ranges      map[byte]LedRange
+	path        string // where the table is persisted, empty to keep it in memory
+	version     int    // incremented on every change
+	calibrating bool   // whether the keyboard is used to edit the ranges
+}
+
+func newKeyMap(path string) *KeyMap {
+	return &KeyMap{
+		ranges: make(map[byte]LedRange),
+		path:   path,
+	}
+}
+
+// Loads the table from its file, missing file means empty table
+func loadKeyMap(path string) (*KeyMap, error) {
+	km := newKeyMap(path)
+	if path == "" {
+		return km, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return km, nil
+	}
+	if err != nil {
+		return km, fmt.Errorf("failed to read key map: %s", err)
+	}
+	if err := json.Unmarshal(data, &km.ranges); err != nil {
+		return km, fmt.Errorf("failed to parse key map: %s", err)
+	}
+	for note, r := range km.ranges {
+		if err := r.validate(); err != nil {
+			return km, fmt.Errorf("invalid range of note %d: %s", note, err)
+		}
+	}
+	return km, nil
+}
+
+func (r LedRange) validate() error {
+	if r.First < 0 || r.Count < 1 {
+		return fmt.Errorf("invalid led range %d+%d", r.First, r.Count)
+	}
+	return nil
+}
+
+// Returns calibrated range of the note if there is one
+func (km *KeyMap) Get(note byte) (LedRange, bool) {
+	if km == nil {
+		return LedRange{}, false
+	}
+	km.mu.RLock()
+	defer km.mu.RUnlock()
+	r, ok := km.ranges[note]
+	return r, ok
+}
+
+// Returns copy of the whole table
+func (km *KeyMap) All() map[byte]LedRange {
+	km.mu.RLock()
+	defer km.mu.RUnlock()
+	ranges := make(map[byte]LedRange, len(km.ranges))
+	for note, r := range km.ranges {
+		ranges[note] = r
+	}
+	return ranges
+}
+
+func (km *KeyMap) Set(note byte, r LedRange) error {
+	if err := r.validate(); err != nil {
+		return err
+	}
+	km.mu.Lock()
+	km.ranges[note] = r
+	km.version++
+	km.mu.Unlock()
+	return km.save()
+}
+
+// Removes calibration of the note, so it uses the uniform layout again
+func (km *KeyMap) Delete(note byte) error {
+	km.mu.Lock()
+	delete(km.ranges, note)
+	km.version++
+	km.mu.Unlock()
+	return km.save()
+}
+
+// Replaces the whole table, nil clears it
+func (km *KeyMap) Replace(ranges map[byte]LedRange) error {
+	if ranges == nil {
+		ranges = make(map[byte]LedRange)
+	}
+	for note, r := range ranges {
+		if err := r.validate(); err != nil {
+			return fmt.Errorf("invalid range of note %d: %s", note, err)
+		}
+	}
+	km.mu.Lock()
+	km.ranges = ranges
+	km.version++
+	km.mu.Unlock()
+	return km.save()
+}
+
+// Returns number which changes whenever the table changes
+func (km *KeyMap) Version() int {
+	if km == nil {
+		return 0
+	}
+	km.mu.RLock()
+	defer km.mu.RUnlock()
+	return km.version
+}
+
+func (km *KeyMap) SetCalibrating(on bool) {
+	km.mu.Lock()
+	km.calibrating = on
+	km.version++
+	km.mu.Unlock()
+}
+
+func (km *KeyMap) Calibrating() bool {
+	if km == nil {
+		return false
+	}
+	km.mu.RLock()
+	defer km.mu.RUnlock()
+	return km.calibrating
+}
+
+func (km *KeyMap) save() error {
+	if km.path == "" {
+		return nil
+	}
+	km.mu.RLock()
+	data, err := json.MarshalIndent(km.ranges, "", "\t")
+	km.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(km.path, data); err != nil {
+		log.Println("Can't save key map", err)
+		return fmt.Errorf("failed to save key map: %s", err)
+	}
+	return nil
+}
+
+// Writes the data to temp file and renames it, so the file is never half written
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Registers http api for editing the key map
+func handleKeyMap(r *mux.Router, keyMap *KeyMap) {
+	// calibrated ranges of all keys
+	r.HandleFunc("/leds/keymap", func(w http.ResponseWriter, r *http.Request) {
+		setupResponse(&w, r)
+		json.NewEncoder(w).Encode(keyMap.All())
+	}).Methods(http.MethodGet)
+
+	r.HandleFunc("/leds/keymap", func(w http.ResponseWriter, r *http.Request) {
+		setupResponse(&w, r)
+		ranges := make(map[byte]LedRange)
+		if err := json.NewDecoder(r.Body).Decode(&ranges); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := keyMap.Replace(ranges); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(keyMap.All())
+	}).Methods(http.MethodPut)
+
+	r.HandleFunc("/leds/keymap/{note:[0-9]+}", func(w http.ResponseWriter, r *http.Request) {
+		setupResponse(&w, r)
+		note, err := noteFromVars(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			lr, ok := keyMap.Get(note)
+			if !ok {
+				http.Error(w, "note not calibrated", http.StatusNotFound)
+				return
+			}
+			json.NewEncoder(w).Encode(lr)
+		case http.MethodPut:
+			lr := LedRange{}
+			if err := json.NewDecoder(r.Body).Decode(&lr); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := keyMap.Set(note, lr); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			json.NewEncoder(w).Encode(lr)
+		case http.MethodDelete:
+			if err := keyMap.Delete(note); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+		}
+	}).Methods(http.MethodGet, http.MethodPut, http.MethodDelete)
+
+	// calibration mode, while active pressed key is lit
+	// and its range is moved by -bri/+bri keys and resized by -sat/+sat keys
+	r.HandleFunc("/leds/calibration", func(w http.ResponseWriter, r *http.Request) {
+		setupResponse(&w, r)
+		if r.Method == http.MethodPut {
+			body := struct {
+				Active bool `json:"active"`
+			}{}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			keyMap.SetCalibrating(body.Active)
+		}
+		json.NewEncoder(w).Encode(map[string]bool{"active": keyMap.Calibrating()})
+	}).Methods(http.MethodGet, http.MethodPut)
+}
+
+func noteFromVars(r *http.Request) (byte, error) {
+	note, err := strconv.Atoi(mux.Vars(r)["note"])
+	if err != nil || note > 127 {
+		return 0, fmt.Errorf("invalid note %q", mux.Vars(r)["note"])
+	}
+	return byte(note), nil
+}
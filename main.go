@@ -11,7 +11,6 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
-	"runtime"
 	"syscall"
 	"time"
 
@@ -19,142 +18,203 @@ import (
 	"github.com/gorilla/mux"
 )
 
-const ADDR = ":1212"
-
-var piancoAddr = flag.String("addr", "wss://pianoecho.draho.cz", "pianco api ws address")
-var wledAddr = flag.String("wled", "192.168.1.3:21324", "udp address of warls")
-var archiveDir = "/home/pi/.local/share/Modartt/Pianoteq/Archive"
-
-func init() {
-	if runtime.GOOS == "windows" { // for local testing
-		archiveDir = "./Archive"
-	}
+// Middleware that only forwards the request to the handlers if it is GET, POST, PUT or DELETE method
+// Handlers modifying the state are registered with explicit methods
+func allowedMethodsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete:
+			// Call the next handler in the chain
+			next.ServeHTTP(w, r)
+		case http.MethodOptions:
+			// Answer the cors preflight
+			setupResponse(&w, r)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			// Return an empty response for other methods
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	})
 }
 
-// Middleware that only forwards the request to the handlers if it is GET method
-func onlyGetMiddleware(next http.Handler) http.Handler {
+// Answers cors preflight of routes registered with explicit methods
+// mux doesn't run middlewares for them, as no method matches OPTIONS
+func methodNotAllowedHandler() http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodGet {
-			// Return an empty response for non-GET methods
-			w.WriteHeader(http.StatusMethodNotAllowed)
+		if r.Method == http.MethodOptions {
+			setupResponse(&w, r)
+			w.WriteHeader(http.StatusNoContent)
 			return
 		}
-		// Call the next handler in the chain
-		next.ServeHTTP(w, r)
+		w.WriteHeader(http.StatusMethodNotAllowed)
 	})
 }
 
 func main() {
 	flag.Parse()
 
-	websocket := getWebSocket(*piancoAddr)
-	messages, closeMidi := getMidiMessages("gopiano")
-	wled, wledPower := getWled(*wledAddr)
+	var err error
+	config, err = loadConfig(*configPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	applyFlags(&config)
+	wledApi := config.Wled.apiUrl()
+
+	websocket, wsClient := getWebSocket(config.Pianco)
+	messages, midiInputs := getMidiMessages(config.Midi)
+	proto, err := parseProtocol(config.Wled.Protocol)
+	if err != nil {
+		log.Fatal(err)
+	}
+	transport, err := newLedTransport(config.ledsAddr(proto), proto, config.Dmx.Universe, config.Dmx.StartChannel, config.Leds.total())
+	if err != nil {
+		log.Fatal("leds dial failed", err)
+	}
+	keyMap, err := loadKeyMap(config.Leds.KeyMap)
+	if err != nil {
+		log.Fatal(err)
+	}
+	presets, err := loadPresets(config.Leds.Presets)
+	if err != nil { // would be overwritten by next saved preset
+		log.Fatal(err)
+	}
+	wled, vis := getWled(wledApi, transport, config.Leds, keyMap, presets)
 
-	GID := byte(0)
-	UID := byte(0)
+	groups := newGroups(config.Pianco)
 
 	r := mux.NewRouter()
+	r.MethodNotAllowedHandler = methodNotAllowedHandler()
 	r.Use(handlers.CompressHandler)
-	r.Use(onlyGetMiddleware)
+	r.Use(allowedMethodsMiddleware)
 
-	// recs := recordingsFromDir(archiveDir)
-	// _ = recs
-	// fmt.Println("archive:", recs.toJSON())
-
-	// Return json containing data of recordings obtained from names of mid files created from pianoteq
-	r.HandleFunc("/archive.json", func(w http.ResponseWriter, r *http.Request) {
-		setupResponse(&w, r)
-		recordings := recordingsFromDir(archiveDir)
-		json.NewEncoder(w).Encode(recordings)
-	})
+	// archive of recordings
+	archive := openArchive(config.ArchiveDir)
+	watchArchive(archive, time.Second*time.Duration(config.ArchivePoll))
+	handleArchive(r, archive.Recordings)
+	handleArchiveEvents(r, archive)
+	handleRecording(r, archive)
+	handleAnalysis(r, archive)
+	handleImages(r, archive)
 
 	// this is to test the pianco api
 	r.HandleFunc("/emitrandomnote", func(w http.ResponseWriter, r *http.Request) {
 		setupResponse(&w, r)
 		// ws.WriteMessage(websocket.TextMessage, []byte("playrandomfile 0 0")) // BinaryMessage
 		note := byte(NOTE_A0 + rand.Intn(NOTE_C8-NOTE_A0))
-		websocket <- []byte{GID, UID, toCmd(CMD_NOTE_ON), note, toVal(0.5)}
-		wled <- []byte{toCmd(CMD_NOTE_ON), note, toVal(0.5)}
+		on := normalizeEvent(Event{Cmd: CMD_NOTE_ON, Key: note, Value: toVal(0.5), Time: time.Now()})
+		for _, msg := range groups.Encode(on) {
+			websocket <- msg
+		}
+		wled <- on
 		<-time.After(time.Second / 2)
-		websocket <- []byte{GID, UID, toCmd(CMD_NOTE_OFF), note}
-		wled <- []byte{toCmd(CMD_NOTE_OFF), note}
-	})
-
-	// toggles the gid value of the ws message (group)
-	r.HandleFunc("/wsout/toggle", func(w http.ResponseWriter, r *http.Request) {
-		setupResponse(&w, r)
-		if GID == 0 {
-			GID = 1
-		} else {
-			GID = 0
+		off := normalizeEvent(Event{Cmd: CMD_NOTE_OFF, Key: note, Time: time.Now()})
+		for _, msg := range groups.Encode(off) {
+			websocket <- msg
 		}
-		json.NewEncoder(w).Encode(GID)
-	})
-	r.HandleFunc("/wsout/get", func(w http.ResponseWriter, r *http.Request) {
-		setupResponse(&w, r)
-		json.NewEncoder(w).Encode(GID)
+		wled <- off
 	})
 
+	handleWebSocket(r, wsClient)
+
+	handleGroups(r, groups)
+
 	// wled api
 	r.HandleFunc("/wled/on", func(w http.ResponseWriter, r *http.Request) {
 		setupResponse(&w, r)
-		wledPower(true)
+		vis.Power(true)
 	})
 
 	r.HandleFunc("/wled/off", func(w http.ResponseWriter, r *http.Request) {
 		setupResponse(&w, r)
-		wledPower(false)
+		vis.Power(false)
 	})
 	r.HandleFunc("/wled/set/bri", func(w http.ResponseWriter, r *http.Request) {
 		setupResponse(&w, r)
-		setWledState(*wledAddr, "bri", 20)
+		setWledState(wledApi, "bri", 20)
 		time.Sleep(time.Second / 2)
-		setWledState(*wledAddr, "bri", 60)
+		setWledState(wledApi, "bri", 60)
 		time.Sleep(time.Second / 2)
-		setWledState(*wledAddr, "bri", 120)
+		setWledState(wledApi, "bri", 120)
 		time.Sleep(time.Second / 2)
-		setWledState(*wledAddr, "bri", 200)
+		setWledState(wledApi, "bri", 200)
 	})
 
 	r.HandleFunc("/wled/get/on", func(w http.ResponseWriter, r *http.Request) {
 		setupResponse(&w, r)
-		on := getWledState(*wledAddr, "on").(bool)
+		on := getWledState(wledApi, "on").(bool)
 		fmt.Println("on", on)
 	})
 
-	// send midi messages from device to server
-	go func() {
-		for {
-			msg := normalizeMidiMsg(<-messages)
-			if isBasicMessage(msg) {
-				// prepe pend gid and uid required by pianco api
-				wrappedMsg := append([]byte{GID, UID}, msg...)
-				websocket <- wrappedMsg
-				wled <- msg
-			}
+	// midi input ports
+	r.HandleFunc("/midi/ports", func(w http.ResponseWriter, r *http.Request) {
+		setupResponse(&w, r)
+		available, opened := midiInputs.Ports()
+		json.NewEncoder(w).Encode(map[string][]string{
+			"available": available,
+			"opened":    opened,
+		})
+	})
+
+	// replaying recordings from archive
+	player := newPlayer(config.ArchiveDir, messages)
+	handlePlayback(r, player)
+
+	// notes of other pianco users
+	relayIncoming(wsClient.Received(), groups, messages)
+
+	// leds calibration api
+	handleKeyMap(r, keyMap)
+	handleVisualizer(r, vis)
+	handlePresets(r, presets, vis)
+
+	// outputs of midi events
+	router := newRouter()
+	router.Add("websocket", SinkFunc(func(ev Event) {
+		// prepend gid and uid required by pianco api
+		for _, msg := range groups.Encode(ev) {
+			websocket <- msg
 		}
-	}()
+	}), SRC_INPUT, SRC_PLAYBACK)
+	router.Add("wled", SinkFunc(func(ev Event) {
+		wled <- ev
+	}))
+	flushRecorder := func() {}
+	if config.Recorder.Enabled {
+		var recorder chan Event
+		recorder, flushRecorder = getRecorder(config.ArchiveDir, time.Second*time.Duration(config.Recorder.IdleGap))
+		router.Add("recorder", SinkFunc(func(ev Event) {
+			recorder <- ev
+		}), SRC_INPUT)
+	}
+	if outs := openMidiOuts(midiInputs, config.Midi); len(outs) > 0 {
+		router.Add("midiout", midiOutSink(outs))
+	}
+	router.Run(messages)
+	handleRouter(r, router)
 
 	// setup cleanup procedures
-	c := make(chan os.Signal)
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-c
-		closeMidi()
-		wledPower(false)
+		midiInputs.Close()
+		wsClient.Close()
+		flushRecorder()
+		vis.Save() // before power off, so the leds are active after restart
+		vis.Power(false)
 		os.Exit(1)
 	}()
 
-	log.Println("Starting", ADDR)
+	log.Println("Starting", config.Listen)
 
-	if err := http.ListenAndServe(ADDR, r); err != nil {
+	if err := http.ListenAndServe(config.Listen, r); err != nil {
 		log.Fatal(err)
 	}
 }
 
 func setupResponse(w *http.ResponseWriter, req *http.Request) {
 	(*w).Header().Set("Access-Control-Allow-Origin", "*")
-	(*w).Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS")
+	(*w).Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, DELETE, OPTIONS")
 	(*w).Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
 }
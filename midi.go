@@ -3,6 +3,11 @@ package main
 import (
 	"fmt"
 	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"gitlab.com/gomidi/midi"
 	"gitlab.com/gomidi/midi/reader"
@@ -12,22 +17,24 @@ import (
 
 const CMD_NOTE_OFF = 0
 const CMD_NOTE_ON = 1
+const CMD_AFTERTOUCH = 2 // polyphonic key pressure
 const CMD_CONTROL_CHANGE = 3
+const CMD_PROGRAM_CHANGE = 4
+const CMD_CHANNEL_PRESSURE = 5
+const CMD_PITCH_BEND = 6
 
 const CC_BANK_0 = 0
 const CC_BANK_1 = 32
 const CC_SUTAIN = 64
+const CC_SOSTENUTO = 66
+const CC_SOFT = 67
 
 const NOTE_A0 = 21
 const NOTE_C8 = 108
 
-const CHANNEL = 3 // this is what roland actually uses as output
+// channel is set by config.Midi.Channel, roland uses 3 as output
 // 1=piano,  2,3=main layer, 9=silent, rest=piano
 
-func toCmd(x int) byte {
-	ch := byte(CHANNEL)
-	return (1<<3|byte(x))<<4 | ch
-}
 func fromCmd(cmd byte) int {
 	return int((cmd >> 4) & 7)
 }
@@ -45,72 +52,251 @@ func fromVal(val byte) float64 {
 	return float64(val) / 127
 }
 
-// will translate 'note on' with zero velocity as 'note off'
-// and sets channel to CHANNEL
-func normalizeMidiMsg(msg []byte) []byte {
-	cmd := msg[0]
-	if fromCmd(cmd) == CMD_NOTE_ON {
-		note := msg[1]
-		velocity := msg[2]
-		if fromVal(velocity) == 0 {
-			cmd = toCmd(CMD_NOTE_OFF)
-			return []byte{cmd, note}
-		}
-	}
-	msg[0] = toCmd(fromCmd(cmd)) // force CHANNEL
-	return msg
-}
+const MIDI_RESCAN = 2 // how often (in seconds) are ports checked for (un)plugged devices
 
-// return true if the midi message is one of:
-// note on
-// note off
-// control change - sustain pedal
-func isBasicMessage(msg []byte) bool {
-	switch fromCmd(msg[0]) {
-	case CMD_NOTE_ON, CMD_NOTE_OFF:
-		return true
-	case CMD_CONTROL_CHANGE:
-		if msg[1] == CC_SUTAIN {
-			return true
-		}
-	}
-	return false
+// MidiInputs keeps hardware input ports matching the config opened
+// and reopens them when the device is plugged back
+type MidiInputs struct {
+	mu       sync.Mutex
+	drv      *driver.Driver
+	names    []string           // port names or regexps to be opened
+	patterns []*regexp.Regexp   // compiled names, nil if not valid regexp
+	virtual  midi.In            // virtual port, nil if not enabled
+	own      string             // name of our virtual output, never listened to
+	opened   map[string]midi.In // by name, reopened when port number changes
+	messages chan Event
+	done     chan bool
 }
 
-// returns a channel witch emmits all
-// messages from all connected midi devices
-// and a cleanup func
-func getMidiMessages(devInName string) (chan []byte, func()) {
-	messages := make(chan []byte)
+// returns a channel witch emmits all channel
+// messages from all connected midi devices as events
+// and the inputs for listing and cleanup
+func getMidiMessages(cfg MidiConfig) (chan Event, *MidiInputs) {
+	messages := make(chan Event)
 
 	drv, err := driver.New()
 	must(err)
 
-	var in midi.In
+	inputs := &MidiInputs{
+		drv:      drv,
+		names:    cfg.Inputs,
+		own:      cfg.VirtualOut,
+		opened:   make(map[string]midi.In),
+		messages: messages,
+		done:     make(chan bool),
+	}
+	for _, name := range cfg.Inputs {
+		re, err := regexp.Compile(name)
+		if err != nil {
+			log.Printf("Midi input %q is not valid regexp, matching exact name", name)
+		}
+		inputs.patterns = append(inputs.patterns, re)
+	}
+
+	if cfg.Virtual != "" {
+		virtIn, err := drv.OpenVirtualIn(cfg.Virtual)
+		must(err)
+		must(virtIn.Open())
+		inputs.listen(virtIn)
+		inputs.virtual = virtIn
+		log.Println("Virt midi in device created:", virtIn.String())
+	}
+
+	if len(cfg.Inputs) > 0 {
+		inputs.scan()
+		go func() {
+			ticker := time.NewTicker(time.Second * MIDI_RESCAN)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					inputs.scan()
+				case <-inputs.done:
+					return
+				}
+			}
+		}()
+	}
 
+	return messages, inputs
+}
+
+// pass every incoming message of the port to the channel
+func (mi *MidiInputs) listen(in midi.In) error {
 	rd := reader.New(
 		reader.NoLogger(),
-		// pass every incoming message to the channel
 		reader.Each(func(pos *reader.Position, msg midi.Message) {
-			messages <- msg.Raw()
+			if ev, ok := eventFromRaw(msg.Raw()); ok {
+				ev.Source = SRC_INPUT
+				mi.messages <- ev
+			}
 			// log.Println("msg captured:", msg.String())
 		}),
 	)
+	return rd.ListenTo(in)
+}
 
-	{
-		virtIn, err := drv.OpenVirtualIn(devInName)
-		must(err)
-		must(virtIn.Open())
-		rd.ListenTo(virtIn)
-		in = virtIn
-		log.Println("Virt midi in device created:", virtIn.String())
+func (mi *MidiInputs) matches(name string) bool {
+	if mi.own != "" && strings.Contains(name, mi.own) { // our output would loop back
+		return false
+	}
+	for i, n := range mi.names {
+		if n == name || mi.patterns[i] != nil && mi.patterns[i].MatchString(name) {
+			return true
+		}
 	}
+	return false
+}
+
+// opens newly plugged matching ports and closes unplugged ones
+func (mi *MidiInputs) scan() {
+	ins, err := mi.drv.Ins()
+	if err != nil {
+		log.Println("Can't list midi ins", err)
+		return
+	}
+	mi.mu.Lock()
+	defer mi.mu.Unlock()
 
-	return messages, func() {
-		fmt.Println("closing midi")
+	present := make(map[string]bool, len(ins))
+	for _, in := range ins {
+		name := in.String()
+		present[name] = true
+		if !mi.matches(name) {
+			continue
+		}
+		if old, ok := mi.opened[name]; ok {
+			if old.Number() == in.Number() && old.IsOpen() {
+				continue
+			}
+			// replugged between scans, the old handle is stale
+			old.StopListening()
+			old.Close()
+			delete(mi.opened, name)
+			log.Println("Midi in device replugged:", name)
+		}
+		if err := in.Open(); err != nil {
+			log.Println("Can't open midi in", name, err)
+			continue
+		}
+		if err := mi.listen(in); err != nil {
+			log.Println("Can't listen to midi in", name, err)
+			in.Close()
+			continue
+		}
+		mi.opened[name] = in
+		log.Println("Midi in device connected:", name)
+	}
+	for name, in := range mi.opened {
+		if !present[name] {
+			in.StopListening()
+			in.Close()
+			delete(mi.opened, name)
+			log.Println("Midi in device disconnected:", name)
+		}
+	}
+}
+
+// Returns names of all available ports and the opened ones
+func (mi *MidiInputs) Ports() (available []string, opened []string) {
+	ins, err := mi.drv.Ins()
+	if err != nil {
+		log.Println("Can't list midi ins", err)
+	}
+	available = []string{}
+	for _, in := range ins {
+		available = append(available, in.String())
+	}
+	mi.mu.Lock()
+	defer mi.mu.Unlock()
+	opened = []string{}
+	if mi.virtual != nil {
+		opened = append(opened, mi.virtual.String())
+	}
+	for name := range mi.opened {
+		opened = append(opened, name)
+	}
+	sort.Strings(opened)
+	return
+}
+
+// Opens output port given by its name or regexp
+func (mi *MidiInputs) openOut(name string) (midi.Out, error) {
+	outs, err := mi.drv.Outs()
+	if err != nil {
+		return nil, fmt.Errorf("can't list midi outs: %s", err)
+	}
+	re, _ := regexp.Compile(name)
+	for _, out := range outs {
+		if out.String() == name || re != nil && re.MatchString(out.String()) {
+			if err := out.Open(); err != nil {
+				return nil, fmt.Errorf("can't open midi out %s: %s", out.String(), err)
+			}
+			log.Println("Midi out device opened:", out.String())
+			return out, nil
+		}
+	}
+	return nil, fmt.Errorf("no midi out matching %q", name)
+}
+
+// Creates virtual output port other apps can listen to
+func (mi *MidiInputs) openVirtualOut(name string) (midi.Out, error) {
+	out, err := mi.drv.OpenVirtualOut(name)
+	if err != nil {
+		return nil, fmt.Errorf("can't create virtual midi out %s: %s", name, err)
+	}
+	if err := out.Open(); err != nil {
+		return nil, fmt.Errorf("can't open virtual midi out %s: %s", name, err)
+	}
+	log.Println("Virt midi out device created:", out.String())
+	return out, nil
+}
+
+// Opens output port and virtual output given by the config
+func openMidiOuts(mi *MidiInputs, cfg MidiConfig) []midi.Out {
+	outs := []midi.Out{}
+	if cfg.Out != "" {
+		out, err := mi.openOut(cfg.Out)
+		if err != nil {
+			log.Println("Can't open midi out", err)
+		} else {
+			outs = append(outs, out)
+		}
+	}
+	if cfg.VirtualOut != "" {
+		out, err := mi.openVirtualOut(cfg.VirtualOut)
+		if err != nil {
+			log.Println(err)
+		} else {
+			outs = append(outs, out)
+		}
+	}
+	return outs
+}
+
+// Returns sink writing events to all the midi outs
+func midiOutSink(outs []midi.Out) Sink {
+	return SinkFunc(func(ev Event) {
+		for _, out := range outs {
+			if _, err := out.Write(ev.Raw()); err != nil {
+				log.Println("Can't write to midi out", err)
+			}
+		}
+	})
+}
+
+func (mi *MidiInputs) Close() {
+	fmt.Println("closing midi")
+	close(mi.done)
+	mi.mu.Lock()
+	for _, in := range mi.opened {
 		in.Close()
-		drv.Close()
 	}
+	if mi.virtual != nil {
+		mi.virtual.Close()
+	}
+	mi.mu.Unlock()
+	mi.drv.Close()
 }
 
 func must(err error) {
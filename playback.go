@@ -0,0 +1,338 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// playback states
+const (
+	PLAYBACK_STOPPED = "stopped"
+	PLAYBACK_PLAYING = "playing"
+	PLAYBACK_PAUSED  = "paused"
+)
+
+// Player replays recordings from the archive
+// Events are injected to the same channel as the live input
+type Player struct {
+	mu        sync.Mutex
+	dir       string        // archive dir
+	output    chan Event    // fan-out of the live input
+	file      string        // path relative to archive dir
+	events    []TimedEvent  // events of the file
+	next      int           // index of next event to be played
+	state     string        // one of PLAYBACK_* constants
+	tempo     float64       // speed ratio, 1 is original
+	position  time.Duration // position in file when started or paused
+	startedAt time.Time     // when the playback (re)started
+	sounding  map[byte]bool // notes on, to be silenced when interrupted
+	wake      chan bool     // interrupts waiting for the next event
+	pending   []Event       // emitted events not yet sent, so the lock is never held while sending
+	ready     chan bool     // wakes the sender when something is pending
+}
+
+type PlayerStatus struct {
+	State    string  `json:"state"`
+	File     string  `json:"file"`
+	Position float64 `json:"position"` // seconds
+	Duration float64 `json:"duration"` // seconds
+	Tempo    float64 `json:"tempo"`
+}
+
+func newPlayer(dir string, output chan Event) *Player {
+	p := &Player{
+		dir:      dir,
+		output:   output,
+		state:    PLAYBACK_STOPPED,
+		tempo:    1,
+		sounding: make(map[byte]bool),
+		wake:     make(chan bool, 1),
+		ready:    make(chan bool, 1),
+	}
+	go p.run()
+	go func() { // sends emitted events in order, slow output blocks only this
+		for range p.ready {
+			p.mu.Lock()
+			events := p.pending
+			p.pending = nil
+			p.mu.Unlock()
+			for _, ev := range events {
+				p.output <- ev
+			}
+		}
+	}()
+	return p
+}
+
+// Loads the file and starts playing it from the beginning
+func (p *Player) Play(file string) error {
+	file = filepath.Clean(filepath.FromSlash(file))
+	if filepath.IsAbs(file) || strings.HasPrefix(file, "..") || filepath.Ext(file) != ".mid" {
+		return fmt.Errorf("invalid recording %q", file)
+	}
+	events, err := readSMFEvents(filepath.Join(p.dir, file))
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	p.silence()
+	p.file = file
+	p.events = events
+	p.seek(0)
+	p.state = PLAYBACK_PLAYING
+	p.startedAt = time.Now()
+	p.mu.Unlock()
+	p.interrupt()
+	return nil
+}
+
+// Continues paused playback
+func (p *Player) Resume() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.state != PLAYBACK_PAUSED {
+		return fmt.Errorf("playback is %s", p.state)
+	}
+	p.state = PLAYBACK_PLAYING
+	p.startedAt = time.Now()
+	p.restorePedals() // released when paused
+	p.interrupt()
+	return nil
+}
+
+func (p *Player) Pause() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.state != PLAYBACK_PLAYING {
+		return fmt.Errorf("playback is %s", p.state)
+	}
+	p.position = p.currentPosition()
+	p.state = PLAYBACK_PAUSED
+	p.silence()
+	p.interrupt()
+	return nil
+}
+
+func (p *Player) Stop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.silence()
+	p.state = PLAYBACK_STOPPED
+	p.seek(0)
+	p.interrupt()
+}
+
+// Moves to the given position in the file
+func (p *Player) Seek(position time.Duration) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.events == nil {
+		return fmt.Errorf("nothing to seek")
+	}
+	p.silence()
+	p.seek(position)
+	if p.state == PLAYBACK_PLAYING { // paused one restores them when resumed
+		p.restorePedals()
+	}
+	p.startedAt = time.Now()
+	p.interrupt()
+	return nil
+}
+
+// Sets the speed ratio of the playback
+func (p *Player) SetTempo(tempo float64) error {
+	if tempo < 0.1 || tempo > 10 {
+		return fmt.Errorf("tempo %v out of range", tempo)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.position = p.currentPosition()
+	p.startedAt = time.Now()
+	p.tempo = tempo
+	p.interrupt()
+	return nil
+}
+
+func (p *Player) Status() PlayerStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	status := PlayerStatus{
+		State:    p.state,
+		File:     filepath.ToSlash(p.file),
+		Position: p.currentPosition().Seconds(),
+		Tempo:    p.tempo,
+	}
+	if len(p.events) > 0 {
+		status.Duration = p.events[len(p.events)-1].At.Seconds()
+	}
+	return status
+}
+
+// must be called locked
+func (p *Player) currentPosition() time.Duration {
+	if p.state != PLAYBACK_PLAYING {
+		return p.position
+	}
+	return p.position + time.Duration(float64(time.Since(p.startedAt))*p.tempo)
+}
+
+// must be called locked
+func (p *Player) seek(position time.Duration) {
+	p.position = position
+	p.next = 0
+	for p.next < len(p.events) && p.events[p.next].At < position {
+		p.next++
+	}
+}
+
+// wakes up the loop to reschedule next event
+func (p *Player) interrupt() {
+	select {
+	case p.wake <- true:
+	default:
+	}
+}
+
+// turns off sounding notes and pedal, must be called locked
+// pedal is released even without notes, it may be down since the last note off
+func (p *Player) silence() {
+	for note := range p.sounding {
+		p.emit(Event{Cmd: CMD_NOTE_OFF, Key: note})
+	}
+	p.emit(Event{Cmd: CMD_CONTROL_CHANGE, Key: CC_SUTAIN, Value: 0})
+	p.sounding = make(map[byte]bool)
+}
+
+// sends pedals as they are at the next event, must be called locked
+// so a passage played from the middle keeps its pedaling
+func (p *Player) restorePedals() {
+	pedals := map[byte]byte{CC_SUTAIN: 0, CC_SOSTENUTO: 0, CC_SOFT: 0}
+	for _, ev := range p.events[:p.next] {
+		if _, ok := pedals[ev.Key]; ok && ev.Cmd == CMD_CONTROL_CHANGE {
+			pedals[ev.Key] = ev.Value
+		}
+	}
+	for _, key := range []byte{CC_SOFT, CC_SOSTENUTO, CC_SUTAIN} {
+		p.emit(Event{Cmd: CMD_CONTROL_CHANGE, Key: key, Value: pedals[key]})
+	}
+}
+
+// queues the event for the sender, must be called locked
+func (p *Player) emit(ev Event) {
+	ev.Time = time.Now()
+	ev.Source = SRC_PLAYBACK
+	switch ev.Cmd {
+	case CMD_NOTE_ON:
+		p.sounding[ev.Key] = true
+	case CMD_NOTE_OFF:
+		delete(p.sounding, ev.Key)
+	}
+	p.pending = append(p.pending, ev)
+	select {
+	case p.ready <- true:
+	default:
+	}
+}
+
+func (p *Player) run() {
+	for {
+		p.mu.Lock()
+		if p.state == PLAYBACK_PLAYING && p.next >= len(p.events) { // finished
+			p.state = PLAYBACK_STOPPED
+			p.silence()
+			p.seek(0)
+		}
+		if p.state != PLAYBACK_PLAYING {
+			p.mu.Unlock()
+			<-p.wake
+			continue
+		}
+		next := p.events[p.next]
+		wait := time.Duration(float64(next.At-p.currentPosition()) / p.tempo)
+		p.mu.Unlock()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+			p.mu.Lock()
+			if p.state == PLAYBACK_PLAYING { // play all events which are due
+				for p.next < len(p.events) && p.events[p.next].At <= p.currentPosition() {
+					p.emit(p.events[p.next].Event)
+					p.next++
+				}
+			}
+			p.mu.Unlock()
+		case <-p.wake:
+			timer.Stop()
+		}
+	}
+}
+
+// Registers http api for controlling the playback
+func handlePlayback(r *mux.Router, player *Player) {
+	writeStatus := func(w http.ResponseWriter, err error) {
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(player.Status())
+	}
+
+	// whether the playback is running, and where
+	r.HandleFunc("/playback", func(w http.ResponseWriter, r *http.Request) {
+		setupResponse(&w, r)
+		json.NewEncoder(w).Encode(player.Status())
+	}).Methods(http.MethodGet)
+
+	// plays file given by its path in archive, or resumes paused playback
+	r.HandleFunc("/playback/play", func(w http.ResponseWriter, r *http.Request) {
+		setupResponse(&w, r)
+		file := r.URL.Query().Get("file")
+		if file == "" {
+			writeStatus(w, player.Resume())
+			return
+		}
+		writeStatus(w, player.Play(file))
+	}).Methods(http.MethodPost)
+
+	r.HandleFunc("/playback/pause", func(w http.ResponseWriter, r *http.Request) {
+		setupResponse(&w, r)
+		writeStatus(w, player.Pause())
+	}).Methods(http.MethodPost)
+
+	r.HandleFunc("/playback/stop", func(w http.ResponseWriter, r *http.Request) {
+		setupResponse(&w, r)
+		player.Stop()
+		writeStatus(w, nil)
+	}).Methods(http.MethodPost)
+
+	// position in seconds
+	r.HandleFunc("/playback/seek", func(w http.ResponseWriter, r *http.Request) {
+		setupResponse(&w, r)
+		position, err := strconv.ParseFloat(r.URL.Query().Get("position"), 64)
+		if err != nil || position < 0 {
+			http.Error(w, "invalid position", http.StatusBadRequest)
+			return
+		}
+		writeStatus(w, player.Seek(time.Duration(position*float64(time.Second))))
+	}).Methods(http.MethodPost)
+
+	// speed ratio, 1 is original
+	r.HandleFunc("/playback/tempo", func(w http.ResponseWriter, r *http.Request) {
+		setupResponse(&w, r)
+		tempo, err := strconv.ParseFloat(r.URL.Query().Get("scale"), 64)
+		if err != nil {
+			http.Error(w, "invalid scale", http.StatusBadRequest)
+			return
+		}
+		writeStatus(w, player.SetTempo(tempo))
+	}).Methods(http.MethodPost)
+}
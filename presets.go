@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+// Preset is a named look of the visualizer
+type Preset struct {
+	Name  string          `json:"name"`
+	Slot  int             `json:"slot"`  // recalled by KEY_PRESET_1 + slot - 1, 0 for none
+	State VisualizerState `json:"state"` // active is ignored when applied
+}
+
+// key recalling the preset, 0 if it has none
+func (p Preset) Key() byte {
+	if p.Slot < 1 || KEY_PRESET_1+p.Slot-1 > NOTE_C8 {
+		return 0
+	}
+	return byte(KEY_PRESET_1 + p.Slot - 1)
+}
+
+func (p Preset) MarshalJSON() ([]byte, error) {
+	type preset Preset // without this method
+	return json.Marshal(struct {
+		preset
+		Key byte `json:"key,omitempty"`
+	}{preset(p), p.Key()})
+}
+
+// Presets are saved looks of the visualizer kept in json file
+type Presets struct {
+	mu      sync.RWMutex
+	path    string
+	presets map[string]Preset
+}
+
+// Loads presets from the file, missing file is not an error
+func loadPresets(path string) (*Presets, error) {
+	ps := &Presets{path: path, presets: make(map[string]Preset)}
+	if path == "" {
+		return ps, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return ps, nil
+	}
+	if err != nil {
+		return ps, fmt.Errorf("failed to read presets: %s", err)
+	}
+	list := []json.RawMessage{}
+	if err := json.Unmarshal(data, &list); err != nil {
+		return ps, fmt.Errorf("failed to parse presets: %s", err)
+	}
+	presets := make(map[string]Preset)
+	slots := map[int]string{}
+	for _, raw := range list {
+		p := Preset{State: defaultVisualizerState()} // settings added later keep their defaults
+		if err := json.Unmarshal(raw, &p); err != nil {
+			return ps, fmt.Errorf("failed to parse presets: %s", err)
+		}
+		if p.Name == "" {
+			return ps, fmt.Errorf("preset has no name")
+		}
+		if _, ok := presets[p.Name]; ok {
+			return ps, fmt.Errorf("duplicate preset %q", p.Name)
+		}
+		if p.Slot < 0 {
+			return ps, fmt.Errorf("invalid slot of preset %q", p.Name)
+		}
+		if other, ok := slots[p.Slot]; ok && p.Slot != 0 {
+			return ps, fmt.Errorf("presets %q and %q share slot %d", other, p.Name, p.Slot)
+		}
+		if err := p.State.validate(); err != nil {
+			return ps, fmt.Errorf("invalid preset %q: %s", p.Name, err)
+		}
+		presets[p.Name] = p
+		slots[p.Slot] = p.Name
+	}
+	ps.presets = presets
+	return ps, nil
+}
+
+// Returns presets ordered by slot and name
+// nil presets are empty
+func (ps *Presets) List() []Preset {
+	list := []Preset{}
+	if ps == nil {
+		return list
+	}
+	ps.mu.RLock()
+	for _, p := range ps.presets {
+		list = append(list, p)
+	}
+	ps.mu.RUnlock()
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Slot != list[j].Slot {
+			return list[i].Slot < list[j].Slot
+		}
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+func (ps *Presets) Get(name string) (Preset, bool) {
+	if ps == nil {
+		return Preset{}, false
+	}
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	p, ok := ps.presets[name]
+	return p, ok
+}
+
+// Returns preset recalled by the key
+func (ps *Presets) ByKey(note byte) (Preset, bool) {
+	for _, p := range ps.List() {
+		if p.Key() != 0 && p.Key() == note {
+			return p, true
+		}
+	}
+	return Preset{}, false
+}
+
+// Creates or replaces the preset, new preset gets the first free slot
+func (ps *Presets) Set(name string, state VisualizerState) (Preset, error) {
+	if name == "" {
+		return Preset{}, fmt.Errorf("preset has no name")
+	}
+	if err := state.validate(); err != nil {
+		return Preset{}, err
+	}
+	ps.mu.Lock()
+	p, ok := ps.presets[name]
+	if !ok {
+		p = Preset{Name: name}
+		used := map[int]bool{}
+		for _, other := range ps.presets {
+			used[other.Slot] = true
+		}
+		for slot := 1; KEY_PRESET_1+slot-1 <= NOTE_C8; slot++ { // none when all keys are taken
+			if !used[slot] {
+				p.Slot = slot
+				break
+			}
+		}
+	}
+	p.State = state
+	ps.presets[name] = p
+	ps.mu.Unlock()
+	return p, ps.save()
+}
+
+// Removes the preset, returns false if there is none of the name
+func (ps *Presets) Delete(name string) (bool, error) {
+	ps.mu.Lock()
+	_, ok := ps.presets[name]
+	delete(ps.presets, name)
+	ps.mu.Unlock()
+	if !ok {
+		return false, nil
+	}
+	return true, ps.save()
+}
+
+func (ps *Presets) save() error {
+	if ps.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(ps.List(), "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(ps.path, data); err != nil {
+		log.Println("Can't save presets", err)
+		return fmt.Errorf("failed to save presets: %s", err)
+	}
+	return nil
+}
+
+// Registers http api for managing and applying presets
+func handlePresets(r *mux.Router, presets *Presets, vis *Visualizer) {
+	r.HandleFunc("/visualizer/presets", func(w http.ResponseWriter, r *http.Request) {
+		setupResponse(&w, r)
+		json.NewEncoder(w).Encode(presets.List())
+	}).Methods(http.MethodGet)
+
+	r.HandleFunc("/visualizer/presets/{name}", func(w http.ResponseWriter, r *http.Request) {
+		setupResponse(&w, r)
+		p, ok := presets.Get(mux.Vars(r)["name"])
+		if !ok {
+			http.Error(w, "no such preset", http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(p)
+	}).Methods(http.MethodGet)
+
+	// saves the current state as the preset, fields given in body override it
+	r.HandleFunc("/visualizer/presets/{name}", func(w http.ResponseWriter, r *http.Request) {
+		setupResponse(&w, r)
+		state := vis.State()
+		if err := json.NewDecoder(r.Body).Decode(&state); err != nil && err != io.EOF {
+			http.Error(w, "invalid body", http.StatusBadRequest)
+			return
+		}
+		p, err := presets.Set(mux.Vars(r)["name"], state)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(p)
+	}).Methods(http.MethodPut)
+
+	r.HandleFunc("/visualizer/presets/{name}", func(w http.ResponseWriter, r *http.Request) {
+		setupResponse(&w, r)
+		ok, err := presets.Delete(mux.Vars(r)["name"])
+		if !ok {
+			http.Error(w, "no such preset", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(presets.List())
+	}).Methods(http.MethodDelete)
+
+	r.HandleFunc("/visualizer/presets/{name}/apply", func(w http.ResponseWriter, r *http.Request) {
+		setupResponse(&w, r)
+		p, ok := presets.Get(mux.Vars(r)["name"])
+		if !ok {
+			http.Error(w, "no such preset", http.StatusNotFound)
+			return
+		}
+		vis.Apply(p)
+		json.NewEncoder(w).Encode(vis.State())
+	}).Methods(http.MethodPost)
+}
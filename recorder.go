@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gitlab.com/gomidi/midi/midimessage/meta"
+	"gitlab.com/gomidi/midi/smf"
+	"gitlab.com/gomidi/midi/smf/smfwriter"
+)
+
+const (
+	RECORDER_BPM        = 120 // tempo of recorded files
+	RECORDER_RESOLUTION = 960 // ticks per quarter note
+)
+
+// Returns a channel which consumes events to be recorded
+// and function which saves the unfinished session (to be called on exit)
+// Session starts with the first note and ends after idleGap without any event,
+// then it is saved to the archive dir the same way pianoteq does it
+func getRecorder(dir string, idleGap time.Duration) (chan Event, func()) {
+	events := make(chan Event, 64)
+	flush := make(chan chan bool)
+
+	go func() {
+		var session []Event
+		idle := time.NewTimer(idleGap)
+		idle.Stop()
+
+		save := func() {
+			if len(session) == 0 {
+				return
+			}
+			pathname, err := saveSession(dir, session)
+			if err != nil {
+				log.Println("Can't save recording", err)
+			} else {
+				log.Println("Recording saved:", pathname)
+			}
+			session = nil
+		}
+
+		for {
+			select {
+			case ev := <-events:
+				if len(session) == 0 && ev.Cmd != CMD_NOTE_ON { // session starts by a note
+					continue
+				}
+				session = append(session, ev)
+				if !idle.Stop() {
+					select { // drain if already fired
+					case <-idle.C:
+					default:
+					}
+				}
+				idle.Reset(idleGap)
+			case <-idle.C:
+				save()
+			case done := <-flush:
+				idle.Stop()
+				save()
+				done <- true
+			}
+		}
+	}()
+
+	return events, func() {
+		done := make(chan bool)
+		flush <- done
+		<-done
+	}
+}
+
+// Returns name of mid file the way pianoteq creates them
+// "2020-08-21 2128 (Friday) 180 notes, 99 seconds.mid"
+func recordingFileName(t time.Time, notes int, seconds int) string {
+	plural := func(n int, word string) string {
+		if n == 1 {
+			return fmt.Sprintf("%d %s", n, word)
+		}
+		return fmt.Sprintf("%d %ss", n, word)
+	}
+	return fmt.Sprintf(
+		"%s (%s) %s, %s.mid",
+		t.Format("2006-01-02 1504"), t.Weekday(), plural(notes, "note"), plural(seconds, "second"),
+	)
+}
+
+// Writes the session as standard midi file into YYYY/MM subdir of the archive
+// returns path of the created file
+func saveSession(dir string, session []Event) (string, error) {
+	start := session[0].Time
+	end := session[len(session)-1].Time
+	notes := 0
+	for _, ev := range session {
+		if ev.Cmd == CMD_NOTE_ON {
+			notes++
+		}
+	}
+	seconds := int(math.Round(end.Sub(start).Seconds()))
+
+	monthDir := filepath.Join(dir, start.Format("2006"), start.Format("01"))
+	if err := os.MkdirAll(monthDir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create archive dir: %s", err)
+	}
+	name := recordingFileName(start, notes, seconds)
+	pathname := filepath.Join(monthDir, name)
+	for i := 2; ; i++ { // sessions ended in the same minute get a suffix
+		if _, err := os.Stat(pathname); os.IsNotExist(err) {
+			break
+		}
+		pathname = filepath.Join(monthDir, fmt.Sprintf("%s (%d).mid", strings.TrimSuffix(name, ".mid"), i))
+	}
+
+	// write to temp file first so nobody reads half written recording
+	tmp, err := ioutil.TempFile(monthDir, ".recording-*.mid")
+	if err != nil {
+		return "", fmt.Errorf("failed to create mid file: %s", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	ticks := smf.MetricTicks(RECORDER_RESOLUTION)
+	wr := smfwriter.New(tmp, smfwriter.TimeFormat(ticks))
+	err = wr.Write(meta.BPM(RECORDER_BPM))
+	last := start
+	for _, ev := range session {
+		if err != nil {
+			break
+		}
+		wr.SetDelta(ticks.Ticks(RECORDER_BPM, ev.Time.Sub(last)))
+		err = wr.Write(ev.Message())
+		last = ev.Time
+	}
+	if err == nil {
+		err = wr.Write(meta.EndOfTrack)
+	}
+	if err == smf.ErrFinished {
+		err = nil
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to write mid file: %s", err)
+	}
+	if err := os.Rename(tmp.Name(), pathname); err != nil {
+		return "", fmt.Errorf("failed to save mid file: %s", err)
+	}
+	return pathname, nil
+}
@@ -1,18 +1,19 @@
 package main
 
 import (
-	"encoding/gob"
 	"encoding/json"
 	"fmt"
-	"io/fs"
 	"log"
 	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strconv"
-	"strings"
 	"time"
 
+	"gitlab.com/gomidi/midi"
 	"gitlab.com/gomidi/midi/midimessage/channel" // (Channel Messages)
+	"gitlab.com/gomidi/midi/reader"
 	"gitlab.com/gomidi/midi/smf"
 	"gitlab.com/gomidi/midi/smf/smfreader"
 )
@@ -22,6 +23,7 @@ type Keys88 = [88]int
 // Recording represent the metadata of
 // a single midi file from the archvie
 type Recording struct {
+	ID       string // stable identifier derived from the path in archive
 	Time     time.Time
 	Duration time.Duration
 	Notes    int64   // kes total (sum of keys)
@@ -34,11 +36,13 @@ func (r *Recording) MarshalJSON() ([]byte, error) {
 		keys = (*r.Keys)[:]
 	}
 	return json.Marshal(&struct {
-		Time     int64 `json:"t"`
-		Duration int64 `json:"d"`
-		Notes    int64 `json:"n"`
-		Keys     []int `json:"k,omitempty"`
+		ID       string `json:"id,omitempty"`
+		Time     int64  `json:"t"`
+		Duration int64  `json:"d"`
+		Notes    int64  `json:"n"`
+		Keys     []int  `json:"k,omitempty"`
 	}{
+		r.ID,
 		r.Time.Unix(),
 		int64(r.Duration.Seconds()),
 		r.Notes,
@@ -46,20 +50,10 @@ func (r *Recording) MarshalJSON() ([]byte, error) {
 	})
 }
 
-var cache88 map[string]*Keys88
-
-func init() {
-	cache88 = make(map[string]*Keys88)
-}
-
 func (r *Recording) load88(pathname string) error {
 	if r.Keys != nil { // already loaded
 		return nil
 	}
-	if p, ok := cache88[pathname]; ok { // use cache
-		r.Keys = p
-		return nil
-	}
 
 	keys88 := Keys88{}
 	sum := 0
@@ -90,8 +84,7 @@ func (r *Recording) load88(pathname string) error {
 		return fmt.Errorf("failed to parse mid file: %s", err.Error())
 	}
 
-	r.Keys = &keys88            // attach to self
-	cache88[pathname] = &keys88 // save to cache
+	r.Keys = &keys88 // attach to self
 
 	if sum != int(r.Notes) {
 		fmt.Printf("invalid keys count (%v): %s\n", sum, pathname)
@@ -100,6 +93,42 @@ func (r *Recording) load88(pathname string) error {
 	return nil
 }
 
+// TimedEvent is an event positioned in time of a midi file
+type TimedEvent struct {
+	At time.Duration // since the start of the file
+	Event
+}
+
+// Reads all channel events of mid file ordered by time
+func readSMFEvents(pathname string) ([]TimedEvent, error) {
+	events := []TimedEvent{}
+	var rd *reader.Reader
+	rd = reader.New(
+		reader.NoLogger(),
+		reader.Each(func(pos *reader.Position, msg midi.Message) {
+			ev, ok := eventFromRaw(msg.Raw())
+			if !ok {
+				return
+			}
+			if ev.Cmd == CMD_NOTE_ON && ev.Value == 0 {
+				ev.Cmd = CMD_NOTE_OFF
+			}
+			at := reader.TimeAt(rd, pos.AbsoluteTicks)
+			if at != nil {
+				events = append(events, TimedEvent{*at, ev})
+			}
+		}),
+	)
+	err := reader.ReadSMFFile(rd, pathname)
+	if err != nil && err != smf.ErrFinished {
+		return nil, fmt.Errorf("failed to parse mid file: %s", err)
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].At < events[j].At
+	})
+	return events, nil
+}
+
 // Recordings is a list of Recording items
 // with toJSON method for debug purposes
 type Recordings []Recording
@@ -112,159 +141,54 @@ func (rs *Recordings) toJSON() string {
 	return string(json)
 }
 
-func recordingFromName(pathName string) Recording {
-	var fileName = filepath.Base(pathName) // "2020-08-21 2128 (Friday) 180 notes, 99 seconds.mid"
-	var parts = strings.Split(fileName, " ")
-	var datePart, timePart, weekdayPart, notesPart, secondsPart string = parts[0], parts[1], parts[2], parts[3], parts[5]
-	_ = weekdayPart
-
-	location, err := time.LoadLocation("Local")
-	if err != nil {
-		log.Fatal(err)
-	}
-	dateTime, err := time.ParseInLocation(
-		"2006-01-02 1504",
-		strings.Join([]string{datePart, timePart}, " "),
-		location,
-	)
-	if err != nil {
-		log.Fatal(err)
-	}
-	duration, err := time.ParseDuration(secondsPart + "s")
-	if err != nil {
-		log.Fatal(err)
-	}
-	notes, err := strconv.ParseInt(notesPart, 10, 64)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	return Recording{
-		Time:     dateTime,
-		Duration: duration,
-		Notes:    notes,
-	}
-}
+// date and time of pianoteq file name, optionally followed by weekday,
+// count of notes and seconds in any language, e.g.:
+// "2020-08-21 2128 (Friday) 180 notes, 99 seconds.mid"
+// "2020-08-21 2128 (vendredi) 1 note, 1 seconde (2).mid"
+var recordingNameRe = regexp.MustCompile(
+	`(\d{4}-\d{2}-\d{2})[ _T]?(\d{2})[:.h]?(\d{2})` + // date and time
+		`(?:\s*\([^)]*\))?` + // weekday
+		`(?:\s+(\d+)\s+[^\d\s,]+,?\s+(\d+)\s+[^\d\s.]+)?`, // notes and seconds
+)
 
-func timeOfDir(dirPath string) *time.Time {
-	var parts = strings.Split(filepath.ToSlash(dirPath), "/")
-	if len(parts) < 2 {
-		return nil
-	}
-	yyyy := parts[len(parts)-2]
-	mm := parts[len(parts)-1]
-	if len(mm) != 2 || len(yyyy) != 4 {
-		return nil
+// Parses the name of pianoteq archive file
+// complete is false when notes or duration are missing in the name
+// err is returned when not even the time can be parsed
+func recordingFromName(pathName string) (rec Recording, complete bool, err error) {
+	fileName := filepath.Base(pathName)
+	m := recordingNameRe.FindStringSubmatch(fileName)
+	if m == nil {
+		return rec, false, fmt.Errorf("no date in file name %q", fileName)
 	}
-	location, err := time.LoadLocation("Local")
+	rec.Time, err = time.ParseInLocation("2006-01-02 1504", m[1]+" "+m[2]+m[3], time.Local)
 	if err != nil {
-		log.Fatal(err)
+		return rec, false, fmt.Errorf("invalid date in file name %q", fileName)
 	}
-	startOfMonth, err := time.ParseInLocation(
-		"2006/01",
-		yyyy+"/"+mm,
-		location,
-	)
-	if err != nil {
-		log.Fatal(err)
+	if m[4] == "" {
+		return rec, false, nil
 	}
-	return &startOfMonth
+	rec.Notes, _ = strconv.ParseInt(m[4], 10, 64)
+	seconds, _ := strconv.ParseInt(m[5], 10, 64)
+	rec.Duration = time.Duration(seconds) * time.Second
+	return rec, true, nil
 }
 
-func recordingsFromDir(dirPath string) Recordings {
-	recordings, err := recordingsFromGob(filepath.Join(dirPath, "/recordings.gob"))
-	var newestCachedMonthEnd time.Time // only cache full month
-	var lenLoaded = len(recordings)
+// Computes the recording from contents of the mid file
+// file is supposed to be modified when the recording ended
+func recordingFromSMF(pathname string, modTime time.Time) (Recording, error) {
+	events, err := readSMFEvents(pathname)
 	if err != nil {
-		fmt.Println(err)
-	} else {
-		newestCachedMonthEnd = endOfMonth(recordings[len(recordings)-1].Time)
-		// fmt.Println("loaded", lenLoaded, newestCachedMonthEnd)
+		return Recording{}, err
 	}
-
-	// stats := loadStats(dirPath)
-	filepath.WalkDir(dirPath, func(pathname string, info fs.DirEntry, err error) error {
-		if err != nil {
-			log.Fatal(err)
-			return nil
-		}
-		if info.IsDir() { // check if the dir is done
-			dirTime := timeOfDir(pathname)
-			if dirTime != nil && !endOfMonth(*dirTime).After(newestCachedMonthEnd) { // dir already in cache
-				// fmt.Println("skipping", pathname)
-				return fs.SkipDir
-			} else {
-				if dirTime != nil && dirTime.Before(time.Now()) && lenLoaded < len(recordings) { // whole month passed
-					err := recordings.saveToGob(filepath.Join(dirPath, "/recordings.gob"))
-					// fmt.Println("saving", pathname, len(recordings))
-					if err != nil {
-						log.Fatal(err)
-					}
-				} else {
-					// fmt.Println("not skipped, not saved", pathname, dirTime, newestCachedMonthEnd, lenLoaded < len(recordings))
-				}
-			}
-			return nil
-		}
-		if filepath.Ext(pathname) != ".mid" { // skip dirs and non midi files
-			return nil
-		}
-		rec := recordingFromName(pathname)
-		if !rec.Time.After(newestCachedMonthEnd) {
-			// checked := false
-			// for _, r := range recordings {
-			// 	if r.Time.Equal(rec.Time) {
-			// 		checked = true
-			// 	}
-			// }
-			// fmt.Println("already in the collection", pathname, checked)
-			return nil
-		}
-		err = rec.load88(pathname)
-		if err != nil {
-			fmt.Println(err)
-			return nil
+	rec := Recording{}
+	for _, ev := range events {
+		if ev.Cmd == CMD_NOTE_ON && ev.Key >= NOTE_A0 && ev.Key <= NOTE_C8 {
+			rec.Notes++
 		}
-		recordings = append(recordings, rec)
-		return nil
-	})
-
-	// fmt.Println("returning", len(recordings))
-
-	return recordings
-}
-
-func recordingsFromGob(gobPath string) (recordings Recordings, err error) {
-	gobFile, err := os.Open(gobPath)
-	if err != nil {
-		err = fmt.Errorf("failed to open for read gob file, %s", err.Error())
-		return
-	}
-	defer gobFile.Close()
-	decoder := gob.NewDecoder(gobFile)
-	err = decoder.Decode(&recordings)
-	if err != nil {
-		err = fmt.Errorf("failed to decode gob file, %s", err.Error())
-	}
-	return
-}
-
-func (recs *Recordings) saveToGob(gobPath string) (err error) {
-	gobFile, err := os.Create(gobPath)
-	if err != nil {
-		err = fmt.Errorf("faield to open for save gob file, %s", err.Error())
-		return
 	}
-	defer gobFile.Close()
-	encoder := gob.NewEncoder(gobFile)
-	err = encoder.Encode(recs)
-	if err != nil {
-		err = fmt.Errorf("faield to encode gob file, %s", err.Error())
+	if len(events) > 0 {
+		rec.Duration = events[len(events)-1].At.Round(time.Second)
 	}
-	return
-}
-
-func endOfMonth(t time.Time) time.Time {
-	y, m, _ := t.Date()
-	return time.Date(y, m, 1, 0, 0, 0, 0, t.Location()).AddDate(0, 1, 0).Add(-time.Nanosecond)
+	rec.Time = modTime.Add(-rec.Duration).Truncate(time.Minute)
+	return rec, nil
 }
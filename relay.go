@@ -0,0 +1,51 @@
+package main
+
+// Encodes the event as pianco message, raw midi prefixed by group and user id
+func encodePianco(gid, uid byte, ev Event) []byte {
+	return append([]byte{gid, uid}, ev.Raw()...)
+}
+
+// Decodes pianco message, returns false if it does not contain channel message
+func decodePianco(data []byte) (gid, uid byte, ev Event, ok bool) {
+	if len(data) < 3 {
+		return 0, 0, Event{}, false
+	}
+	ev, ok = eventFromRaw(data[2:])
+	if !ok {
+		return 0, 0, Event{}, false
+	}
+	if ev.Cmd == CMD_NOTE_ON && ev.Value == 0 {
+		ev.Cmd = CMD_NOTE_OFF
+	}
+	ev.Source = SRC_REMOTE
+	ev.User = data[1]
+	return data[0], data[1], ev, true
+}
+
+// Whether the message releases a note or pedal, such message is never dropped
+func isPiancoRelease(data []byte) bool {
+	_, _, ev, ok := decodePianco(data)
+	return ok && ev.IsRelease()
+}
+
+// Plays messages of other users of received groups from pianco relay
+// events are passed to output, the same channel as the live input
+func relayIncoming(received chan []byte, groups *Groups, output chan Event) {
+	go func() {
+		for data := range received {
+			gid, uid, ev, ok := decodePianco(data)
+			if !ok {
+				continue
+			}
+			if !groups.Accepts(gid, uid) { // other group or our own echo
+				continue
+			}
+			output <- ev
+		}
+	}()
+}
+
+// Returns colour of notes of remote user, hues of users are far apart
+func userColor(uid byte) RGB {
+	return colorHStoRGB(int(uid)*137, state.Saturation)
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// default, minimal and maximal size of rendered images
+const (
+	ROLL_WIDTH     = 1200
+	ROLL_HEIGHT    = 440 // 5px per key
+	HEATMAP_WIDTH  = 880 // 10px per key
+	HEATMAP_HEIGHT = 120
+	IMAGE_MIN      = 88   // a pixel per key at least
+	IMAGE_MAX      = 2000 // png of this size takes 16 MB
+)
+
+var (
+	ROLL_BKG    = RGB{0x10, 0x10, 0x18}
+	ROLL_BLACK  = RGB{0x08, 0x08, 0x0c} // rows of black keys
+	ROLL_PEDAL  = RGB{0x40, 0x40, 0x50}
+	HEATMAP_BKG = RGB{0x30, 0x30, 0x30}
+)
+
+// Canvas is a target of drawing, raster or vector
+type Canvas interface {
+	Rect(x, y, w, h float64, rgb RGB)
+	Encode() ([]byte, string) // returns the data and its content type
+}
+
+type pngCanvas struct {
+	img *image.RGBA
+}
+
+func newPngCanvas(width, height int) *pngCanvas {
+	return &pngCanvas{image.NewRGBA(image.Rect(0, 0, width, height))}
+}
+
+func (c *pngCanvas) Rect(x, y, w, h float64, rgb RGB) {
+	rect := image.Rect(int(x), int(y), int(x+w+0.5), int(y+h+0.5))
+	if rect.Dx() == 0 { // keep very short notes visible
+		rect.Max.X++
+	}
+	draw.Draw(c.img, rect, &image.Uniform{color.RGBA{rgb[0], rgb[1], rgb[2], 255}}, image.Point{}, draw.Src)
+}
+
+func (c *pngCanvas) Encode() ([]byte, string) {
+	buf := bytes.Buffer{}
+	png.Encode(&buf, c.img)
+	return buf.Bytes(), "image/png"
+}
+
+type svgCanvas struct {
+	buf bytes.Buffer
+}
+
+func newSvgCanvas(width, height int) *svgCanvas {
+	c := &svgCanvas{}
+	fmt.Fprintf(&c.buf, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`, width, height, width, height)
+	return c
+}
+
+func (c *svgCanvas) Rect(x, y, w, h float64, rgb RGB) {
+	fmt.Fprintf(&c.buf, `<rect x="%.1f" y="%.1f" width="%.1f" height="%.1f" fill="#%02x%02x%02x"/>`, x, y, w, h, rgb[0], rgb[1], rgb[2])
+}
+
+func (c *svgCanvas) Encode() ([]byte, string) {
+	return append(c.buf.Bytes(), "</svg>"...), "image/svg+xml"
+}
+
+func newCanvas(format string, width, height int) Canvas {
+	if format == "svg" {
+		return newSvgCanvas(width, height)
+	}
+	return newPngCanvas(width, height)
+}
+
+// is the note (midi value) a black key
+func isBlackKey(note int) bool {
+	switch note % 12 {
+	case 1, 3, 6, 8, 10:
+		return true
+	}
+	return false
+}
+
+// colour from blue (cold) to red (hot), t is 0..1
+func heatColor(t float64) RGB {
+	return colorHStoRGB(int(240*(1-t)), 255)
+}
+
+// Draws notes as bars, time goes left to right, highest key is on top
+func renderRoll(c Canvas, ne NoteEvents, width, height int) {
+	w, h := float64(width), float64(height)
+	keyH := h / 88
+	c.Rect(0, 0, w, h, ROLL_BKG)
+	for key := 0; key < 88; key++ {
+		if isBlackKey(key + NOTE_A0) {
+			c.Rect(0, h-float64(key+1)*keyH, w, keyH, ROLL_BLACK)
+		}
+	}
+	if ne.Duration == 0 {
+		return
+	}
+	scale := w / float64(ne.Duration)
+	for _, s := range ne.Sustain { // pedal as a line at the bottom
+		c.Rect(float64(s[0])*scale, h-2, float64(s[1])*scale, 2, ROLL_PEDAL)
+	}
+	for _, n := range ne.Notes {
+		key := int(n[2]) - NOTE_A0
+		if key < 0 || key >= 88 {
+			continue
+		}
+		c.Rect(float64(n[0])*scale, h-float64(key+1)*keyH, float64(n[1])*scale, keyH, heatColor(float64(n[3])/127))
+	}
+}
+
+// Draws keys as columns coloured by how many times they were played
+// black keys are shorter like on the keyboard
+func renderHeatmap(c Canvas, keys Keys88, width, height int) {
+	w, h := float64(width), float64(height)
+	keyW := w / 88
+	gap := 1.0 // between keys, none when they are too narrow
+	if keyW < 3 {
+		gap = 0
+	}
+	c.Rect(0, 0, w, h, HEATMAP_BKG)
+	max := 0
+	for _, n := range keys {
+		if n > max {
+			max = n
+		}
+	}
+	for key, n := range keys {
+		rgb := BLACK
+		if n > 0 {
+			rgb = heatColor(float64(n) / float64(max))
+		}
+		keyH := h
+		if isBlackKey(key + NOTE_A0) {
+			keyH = h * 0.6
+		}
+		c.Rect(float64(key)*keyW+gap/2, 0, keyW-gap, keyH, rgb)
+	}
+}
+
+// Returns image size from width and height url params or the defaults
+func imageSize(r *http.Request, width, height int) (int, int, error) {
+	size := []*int{&width, &height}
+	for i, name := range []string{"width", "height"} {
+		if v := r.URL.Query().Get(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return 0, 0, fmt.Errorf("invalid %s %q", name, v)
+			}
+			if n < IMAGE_MIN || n > IMAGE_MAX {
+				return 0, 0, fmt.Errorf("%s %d out of range %d-%d", name, n, IMAGE_MIN, IMAGE_MAX)
+			}
+			*size[i] = n
+		}
+	}
+	return width, height, nil
+}
+
+func writeImage(w http.ResponseWriter, c Canvas) {
+	data, contentType := c.Encode()
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "max-age=60")
+	w.Write(data)
+}
+
+// Registers http api for images of recordings
+// {format} is png or svg, size is given by width and height params
+func handleImages(r *mux.Router, archive *Archive) {
+	// piano roll of single recording
+	r.HandleFunc("/archive/{id:"+ID_PATTERN+"}/roll.{format:png|svg}", func(w http.ResponseWriter, r *http.Request) {
+		setupResponse(&w, r)
+		width, height, err := imageSize(r, ROLL_WIDTH, ROLL_HEIGHT)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		rec, rel, err := archive.Get(mux.Vars(r)["id"])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		events, err := readSMFEvents(archive.Path(rel))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		c := newCanvas(mux.Vars(r)["format"], width, height)
+		renderRoll(c, noteEvents(rec.ID, events), width, height)
+		writeImage(w, c)
+	}).Methods(http.MethodGet)
+
+	// keys of single recording
+	r.HandleFunc("/archive/{id:"+ID_PATTERN+"}/heatmap.{format:png|svg}", func(w http.ResponseWriter, r *http.Request) {
+		setupResponse(&w, r)
+		width, height, err := imageSize(r, HEATMAP_WIDTH, HEATMAP_HEIGHT)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		rec, _, err := archive.Get(mux.Vars(r)["id"])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		keys := Keys88{}
+		if rec.Keys != nil {
+			keys = *rec.Keys
+		}
+		c := newCanvas(mux.Vars(r)["format"], width, height)
+		renderHeatmap(c, keys, width, height)
+		writeImage(w, c)
+	}).Methods(http.MethodGet)
+
+	// keys of all recordings matching the same filters as archive.json
+	r.HandleFunc("/archive/heatmap.{format:png|svg}", func(w http.ResponseWriter, r *http.Request) {
+		setupResponse(&w, r)
+		width, height, err := imageSize(r, HEATMAP_WIDTH, HEATMAP_HEIGHT)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		q, err := parseArchiveQuery(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		q.Offset, q.Limit = 0, 0
+		matching, _ := q.Apply(archive.Recordings())
+		keys := Keys88{}
+		copy(keys[:], archiveStats(matching, "day").Keys)
+		c := newCanvas(mux.Vars(r)["format"], width, height)
+		renderHeatmap(c, keys, width, height)
+		writeImage(w, c)
+	}).Methods(http.MethodGet)
+}
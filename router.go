@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+// overflow policies of full queues
+// releases of notes and pedals are never dropped, the queue grows past its size for them
+// router itself never waits, a slow sink blocks only its own goroutine
+const (
+	DROP_OLDEST = "oldest" // make room by dropping the oldest queued item
+	DROP_NEWEST = "newest" // drop the new item
+	DROP_NONE   = "none"   // keep everything, the queue grows until the sink catches up
+)
+
+// Sink is an output of the midi events
+type Sink interface {
+	Write(ev Event)
+}
+
+// SinkFunc adapts a function to Sink
+type SinkFunc func(ev Event)
+
+func (f SinkFunc) Write(ev Event) {
+	f(ev)
+}
+
+// SinkStatus describes the sink for http api
+type SinkStatus struct {
+	Name      string   `json:"name"`
+	Enabled   bool     `json:"enabled"`
+	Filter    []string `json:"filter"`  // passed event categories, empty for all
+	Sources   []string `json:"sources"` // passed event sources, empty for all
+	Overflow  string   `json:"overflow"`
+	Queued    int      `json:"queued"`
+	Delivered int64    `json:"delivered"`
+	Dropped   int64    `json:"dropped"`
+}
+
+// routedSink is a sink with its own queue, so a slow sink doesn't block the others
+type routedSink struct {
+	mu        sync.Mutex
+	pushed    *sync.Cond // wakes the sink goroutine
+	name      string
+	sink      Sink
+	filter    EventFilter
+	sources   map[string]bool
+	overflow  string
+	enabled   bool
+	queue     []Event
+	size      int // max queued events, except releases and DROP_NONE
+	delivered int64
+	dropped   int64
+}
+
+// Router passes every event to all enabled sinks accepting it
+type Router struct {
+	mu    sync.RWMutex
+	sinks []*routedSink
+}
+
+func newRouter() *Router {
+	return &Router{}
+}
+
+// Adds the sink named by its config key, filter is taken from config.Midi.Filters
+// and queue from config.Sinks, sources limits the passed events (e.g. SRC_INPUT), none for all
+// sources of the sink config take precedence
+func (rt *Router) Add(name string, sink Sink, sources ...string) {
+	cfg := config.sinkConfig(name)
+	if len(cfg.Sources) > 0 {
+		sources = cfg.Sources
+	}
+	filter, err := newEventFilter(config.Midi.Filters[name])
+	if err != nil {
+		log.Println("Invalid filter of", name, err)
+	}
+	rs := &routedSink{
+		name:     name,
+		sink:     sink,
+		filter:   filter,
+		sources:  map[string]bool{},
+		overflow: cfg.Overflow,
+		enabled:  !cfg.Disabled,
+		size:     cfg.Queue,
+	}
+	rs.pushed = sync.NewCond(&rs.mu)
+	for _, src := range sources {
+		rs.sources[src] = true
+	}
+	go func() {
+		for {
+			rs.mu.Lock()
+			for len(rs.queue) == 0 {
+				rs.pushed.Wait()
+			}
+			ev := rs.queue[0]
+			rs.queue = rs.queue[1:]
+			rs.mu.Unlock()
+
+			rs.sink.Write(ev)
+			rs.mu.Lock()
+			rs.delivered++
+			rs.mu.Unlock()
+		}
+	}()
+
+	rt.mu.Lock()
+	rt.sinks = append(rt.sinks, rs)
+	rt.mu.Unlock()
+}
+
+// Queues the event to all sinks accepting it
+func (rt *Router) Route(ev Event) {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+	for _, rs := range rt.sinks {
+		rs.push(ev)
+	}
+}
+
+// Routes all events of the channel, normalized
+func (rt *Router) Run(events chan Event) {
+	go func() {
+		for ev := range events {
+			rt.Route(normalizeEvent(ev))
+		}
+	}()
+}
+
+func (rs *routedSink) push(ev Event) {
+	if !rs.filter.Pass(ev) || len(rs.sources) > 0 && !rs.sources[ev.Source] {
+		return
+	}
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if !rs.enabled {
+		return
+	}
+	if len(rs.queue) >= rs.size && rs.overflow != DROP_NONE {
+		i := -1
+		if rs.overflow == DROP_OLDEST {
+			i = rs.oldestDroppable()
+		}
+		switch {
+		case i >= 0:
+			rs.queue = append(rs.queue[:i:i], rs.queue[i+1:]...)
+			rs.dropped++
+		case !ev.IsRelease(): // newest, or the queue is full of releases
+			rs.dropped++
+			return
+		}
+	}
+	rs.queue = append(rs.queue, ev)
+	rs.pushed.Signal()
+}
+
+// index of the oldest queued event which is not release, -1 if there is none
+// must be called locked
+func (rs *routedSink) oldestDroppable() int {
+	for i, ev := range rs.queue {
+		if !ev.IsRelease() {
+			return i
+		}
+	}
+	return -1
+}
+
+func (rs *routedSink) status() SinkStatus {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	status := SinkStatus{
+		Name:      rs.name,
+		Enabled:   rs.enabled,
+		Filter:    []string{},
+		Sources:   []string{},
+		Overflow:  rs.overflow,
+		Queued:    len(rs.queue),
+		Delivered: rs.delivered,
+		Dropped:   rs.dropped,
+	}
+	for _, c := range eventCategories {
+		if rs.filter[c] {
+			status.Filter = append(status.Filter, c)
+		}
+	}
+	for src := range rs.sources {
+		status.Sources = append(status.Sources, src)
+	}
+	sort.Strings(status.Sources)
+	return status
+}
+
+func (rt *Router) Status() []SinkStatus {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+	list := []SinkStatus{}
+	for _, rs := range rt.sinks {
+		list = append(list, rs.status())
+	}
+	return list
+}
+
+// Enables or disables the sink, events are not queued to disabled sink
+func (rt *Router) SetEnabled(name string, enabled bool) error {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+	for _, rs := range rt.sinks {
+		if rs.name == name {
+			rs.mu.Lock()
+			rs.enabled = enabled
+			rs.mu.Unlock()
+			return nil
+		}
+	}
+	return fmt.Errorf("no sink %q", name)
+}
+
+// Registers http api for listing and switching sinks
+func handleRouter(r *mux.Router, router *Router) {
+	r.HandleFunc("/sinks", func(w http.ResponseWriter, r *http.Request) {
+		setupResponse(&w, r)
+		json.NewEncoder(w).Encode(router.Status())
+	}).Methods(http.MethodGet)
+
+	// {"enabled": false}
+	r.HandleFunc("/sinks/{name}", func(w http.ResponseWriter, r *http.Request) {
+		setupResponse(&w, r)
+		body := struct {
+			Enabled *bool `json:"enabled"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Enabled == nil {
+			http.Error(w, "invalid body", http.StatusBadRequest)
+			return
+		}
+		if err := router.SetEnabled(mux.Vars(r)["name"], *body.Enabled); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(router.Status())
+	}).Methods(http.MethodPut)
+}
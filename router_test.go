@@ -0,0 +1,94 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// routes events to sink "fast" and to sink "slow" which stalls on the first event
+// until all are routed
+// returns events delivered to both
+func routeToStalledSink(t *testing.T, overflow string, events []Event) (slow []Event, fast []Event) {
+	t.Helper()
+	saved := config
+	defer func() { config = saved }()
+	config.Sinks = map[string]SinkConfig{"slow": {Queue: 2, Overflow: overflow}}
+
+	stall := make(chan bool)
+	stalled := make(chan bool, 1)
+	slowCh := make(chan Event, 100)
+	fastCh := make(chan Event, 100)
+	rt := newRouter()
+	rt.Add("slow", SinkFunc(func(ev Event) {
+		select {
+		case stalled <- true: // holding the first event
+		default:
+		}
+		<-stall
+		slowCh <- ev
+	}))
+	rt.Add("fast", SinkFunc(func(ev Event) {
+		fastCh <- ev
+	}))
+
+	rt.Route(events[0])
+	<-stalled
+	routed := make(chan bool)
+	go func() {
+		for _, ev := range events[1:] {
+			rt.Route(ev)
+		}
+		close(routed)
+	}()
+	select {
+	case <-routed:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("routing blocked by stalled sink")
+	}
+	for range events {
+		select {
+		case ev := <-fastCh:
+			fast = append(fast, ev)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("fast sink got only %d events", len(fast))
+		}
+	}
+
+	close(stall)
+	for {
+		select {
+		case ev := <-slowCh:
+			slow = append(slow, ev)
+		case <-time.After(200 * time.Millisecond):
+			return slow, fast
+		}
+	}
+}
+
+func TestRouterStalledSink(t *testing.T) {
+	on := func(key byte) Event { return Event{Cmd: CMD_NOTE_ON, Key: key, Value: 100} }
+	off := func(key byte) Event { return Event{Cmd: CMD_NOTE_OFF, Key: key} }
+	pedalUp := Event{Cmd: CMD_CONTROL_CHANGE, Key: CC_SUTAIN, Value: 0}
+	events := []Event{on(60), off(60), on(61), off(61), on(62), pedalUp, off(62)}
+
+	tests := []struct {
+		overflow string
+		want     []Event // delivered to the slow sink, the first one is taken before it stalls
+	}{
+		{DROP_OLDEST, []Event{on(60), off(60), off(61), pedalUp, off(62)}},
+		{DROP_NEWEST, []Event{on(60), off(60), on(61), off(61), pedalUp, off(62)}},
+		{DROP_NONE, events},
+	}
+	for _, tt := range tests {
+		t.Run(tt.overflow, func(t *testing.T) {
+			slow, fast := routeToStalledSink(t, tt.overflow, events)
+			if !reflect.DeepEqual(fast, events) {
+				t.Errorf("fast sink got %v, want %v", fast, events)
+			}
+			if !reflect.DeepEqual(slow, tt.want) {
+				t.Errorf("slow sink got %v, want %v", slow, tt.want)
+			}
+		})
+	}
+}
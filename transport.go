@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// max number of leds which fits into single packet of given protocol
+const (
+	WARLS_MAX_LEDS = 255
+	DRGB_MAX_LEDS  = 490
+	DRGBW_MAX_LEDS = 367
+	DNRGB_MAX_LEDS = 489
+)
+
+// LedTransport delivers rendered led buffer (3 bytes per led) to the strip
+type LedTransport interface {
+	// Send the buffer, wait is number of seconds before the strip leaves realtime mode
+	Send(buffer []byte, wait byte) error
+	Close() error
+}
+
+var protocolNames = map[string]int{
+	"warls":  WARLS,
+	"drgb":   DRGB,
+	"drgbw":  DRGBW,
+	"dnrgb":  DNRGB,
+	"e131":   E131,
+	"artnet": ARTNET,
+}
+
+// Returns protocol constant by its name (case insensitive)
+func parseProtocol(name string) (int, error) {
+	proto, ok := protocolNames[strings.ToLower(name)]
+	if !ok {
+		return 0, fmt.Errorf("unknown led protocol %q", name)
+	}
+	return proto, nil
+}
+
+// Creates transport for given protocol
+// universe, startChannel and leds (on the strip) are used by dmx protocols only
+func newLedTransport(addr string, proto int, universe int, startChannel int, leds int) (LedTransport, error) {
+	switch proto {
+	case E131, ARTNET:
+		return newDmxTransport(addr, proto, universe, startChannel, leds)
+	default:
+		return newWledTransport(addr, proto)
+	}
+}
+
+// wledTransport speaks one of the wled udp realtime protocols
+type wledTransport struct {
+	addr  string
+	proto int
+	conn  net.Conn
+}
+
+func newWledTransport(addr string, proto int) (*wledTransport, error) {
+	if proto < WARLS || proto > DNRGB {
+		return nil, fmt.Errorf("unsupported wled protocol %d", proto)
+	}
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &wledTransport{addr, proto, conn}, nil
+}
+
+func (t *wledTransport) Send(buffer []byte, wait byte) error {
+	for _, packet := range wledPackets(t.proto, buffer, wait) {
+		if err := t.write(packet); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// write single packet, re-dial once if it fails
+func (t *wledTransport) write(packet []byte) error {
+	_, err := t.conn.Write(packet)
+	if err == nil {
+		return nil
+	}
+	conn, err := net.Dial("udp", t.addr)
+	if err != nil {
+		return fmt.Errorf("no udp connection: %s", err)
+	}
+	t.conn.Close()
+	t.conn = conn
+	if _, err := t.conn.Write(packet); err != nil {
+		return fmt.Errorf("second send try failed: %s", err)
+	}
+	return nil
+}
+
+func (t *wledTransport) Close() error {
+	return t.conn.Close()
+}
+
+// Encodes the led buffer into packets of given realtime protocol
+// Leds which does not fit into the protocol are omitted,
+// only DNRGB splits longer strips to multiple packets
+func wledPackets(proto int, buffer []byte, wait byte) [][]byte {
+	leds := len(buffer) / 3
+	switch proto {
+	case WARLS: // index + rgb for every led
+		if leds > WARLS_MAX_LEDS {
+			leds = WARLS_MAX_LEDS
+		}
+		packet := make([]byte, 0, 2+leds*4)
+		packet = append(packet, WARLS, wait)
+		for i := 0; i < leds; i++ {
+			packet = append(packet, byte(i))
+			packet = append(packet, buffer[i*3:i*3+3]...)
+		}
+		return [][]byte{packet}
+	case DRGB: // rgb of leds from the start
+		if leds > DRGB_MAX_LEDS {
+			leds = DRGB_MAX_LEDS
+		}
+		packet := make([]byte, 0, 2+leds*3)
+		packet = append(packet, DRGB, wait)
+		packet = append(packet, buffer[:leds*3]...)
+		return [][]byte{packet}
+	case DRGBW: // rgbw of leds from the start
+		if leds > DRGBW_MAX_LEDS {
+			leds = DRGBW_MAX_LEDS
+		}
+		packet := make([]byte, 0, 2+leds*4)
+		packet = append(packet, DRGBW, wait)
+		for i := 0; i < leds; i++ {
+			var rgb RGB
+			copy(rgb[:], buffer[i*3:i*3+3])
+			packet = append(packet, rgbToRGBW(rgb)...)
+		}
+		return [][]byte{packet}
+	case DNRGB: // start index + rgb, one packet per chunk
+		packets := [][]byte{}
+		for start := 0; start < leds; start += DNRGB_MAX_LEDS {
+			end := start + DNRGB_MAX_LEDS
+			if end > leds {
+				end = leds
+			}
+			packet := make([]byte, 0, 4+(end-start)*3)
+			packet = append(packet, DNRGB, wait, byte(start>>8), byte(start&0xFF))
+			packet = append(packet, buffer[start*3:end*3]...)
+			packets = append(packets, packet)
+		}
+		return packets
+	}
+	return nil
+}
+
+// Extracts the common white component of the color to the dedicated white channel
+func rgbToRGBW(rgb RGB) []byte {
+	w := rgb[0]
+	if rgb[1] < w {
+		w = rgb[1]
+	}
+	if rgb[2] < w {
+		w = rgb[2]
+	}
+	return []byte{rgb[0] - w, rgb[1] - w, rgb[2] - w, w}
+}
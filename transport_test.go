@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// buffer of n leds, every led has its own value
+func testLeds(n int) []byte {
+	buf := make([]byte, n*3)
+	for i := range buf {
+		buf[i] = byte(i/3 + 1)
+	}
+	return buf
+}
+
+func TestWledPackets(t *testing.T) {
+	tests := []struct {
+		name   string
+		proto  int
+		buffer []byte
+		want   [][]byte
+	}{
+		{"warls", WARLS, []byte{0xff, 0x80, 0x01, 0x10, 0x20, 0x30}, [][]byte{{
+			0x01, 0x05, // protocol and wait
+			0x00, 0xff, 0x80, 0x01, // index and rgb
+			0x01, 0x10, 0x20, 0x30,
+		}}},
+		{"drgb", DRGB, []byte{0xff, 0x80, 0x01, 0x10, 0x20, 0x30}, [][]byte{{
+			0x02, 0x05,
+			0xff, 0x80, 0x01,
+			0x10, 0x20, 0x30,
+		}}},
+		{"drgbw extracts white", DRGBW, []byte{0xff, 0x80, 0x01, 0x10, 0x20, 0x30}, [][]byte{{
+			0x03, 0x05,
+			0xfe, 0x7f, 0x00, 0x01,
+			0x00, 0x10, 0x20, 0x10,
+		}}},
+		{"dnrgb", DNRGB, []byte{0xff, 0x80, 0x01, 0x10, 0x20, 0x30}, [][]byte{{
+			0x04, 0x05,
+			0x00, 0x00, // start index
+			0xff, 0x80, 0x01,
+			0x10, 0x20, 0x30,
+		}}},
+		{"partial led is omitted", DRGB, []byte{0xff, 0x80, 0x01, 0x10}, [][]byte{{
+			0x02, 0x05,
+			0xff, 0x80, 0x01,
+		}}},
+		{"empty", DNRGB, nil, [][]byte{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := wledPackets(tt.proto, tt.buffer, 5)
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d packets, want %d", len(got), len(tt.want))
+			}
+			for i := range got {
+				if !bytes.Equal(got[i], tt.want[i]) {
+					t.Errorf("packet %d\n got % x\nwant % x", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestWledPacketsLimits(t *testing.T) {
+	tests := []struct {
+		name    string
+		proto   int
+		leds    int
+		header  int
+		perLed  int
+		maxLeds int
+	}{
+		{"warls", WARLS, 300, 2, 4, WARLS_MAX_LEDS},
+		{"drgb", DRGB, 600, 2, 3, DRGB_MAX_LEDS},
+		{"drgbw", DRGBW, 600, 2, 4, DRGBW_MAX_LEDS},
+		{"drgb fits", DRGB, DRGB_MAX_LEDS, 2, 3, DRGB_MAX_LEDS},
+		{"warls fits", WARLS, 10, 2, 4, 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			packets := wledPackets(tt.proto, testLeds(tt.leds), 1)
+			if len(packets) != 1 {
+				t.Fatalf("got %d packets, want 1", len(packets))
+			}
+			if got, want := len(packets[0]), tt.header+tt.maxLeds*tt.perLed; got != want {
+				t.Errorf("packet has %d bytes, want %d", got, want)
+			}
+		})
+	}
+	if last := wledPackets(WARLS, testLeds(300), 1)[0][2+254*4]; last != 254 {
+		t.Errorf("index of last warls led is %d, want 254", last)
+	}
+}
+
+func TestDnrgbSplit(t *testing.T) {
+	tests := []struct {
+		name   string
+		leds   int
+		starts []int // start index of every packet
+	}{
+		{"fits one", DNRGB_MAX_LEDS, []int{0}},
+		{"one led over", DNRGB_MAX_LEDS + 1, []int{0, 489}},
+		{"start over 255", 3 * DNRGB_MAX_LEDS, []int{0, 489, 978}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := testLeds(tt.leds)
+			packets := wledPackets(DNRGB, buf, 2)
+			if len(packets) != len(tt.starts) {
+				t.Fatalf("got %d packets, want %d", len(packets), len(tt.starts))
+			}
+			joined := []byte{}
+			for i, packet := range packets {
+				if packet[0] != DNRGB || packet[1] != 2 {
+					t.Errorf("packet %d header % x", i, packet[:2])
+				}
+				start := tt.starts[i]
+				if packet[2] != byte(start>>8) || packet[3] != byte(start) { // high byte first
+					t.Errorf("packet %d starts at % x, want %d", i, packet[2:4], start)
+				}
+				if leds := (len(packet) - 4) / 3; leds > DNRGB_MAX_LEDS {
+					t.Errorf("packet %d has %d leds", i, leds)
+				}
+				joined = append(joined, packet[4:]...)
+			}
+			if !bytes.Equal(joined, buf) {
+				t.Errorf("leds changed by splitting")
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"math"
+)
+
+// how velocity changes the color of the note
+const (
+	VEL_NONE       = iota // all notes look the same
+	VEL_BRIGHTNESS        // louder notes are brighter
+	VEL_HUE               // hue is shifted by velocity, soft notes one way, loud the other
+	VEL_BOTH
+)
+
+// response curves mapping velocity to level
+const (
+	CURVE_LINEAR = iota
+	CURVE_LOG    // soft notes are boosted
+	CURVE_TABLE  // given by the velocity table
+)
+
+const (
+	VELOCITY_HUE_SHIFT      = 60  // degrees of hue between the softest and loudest note
+	VELOCITY_MIN_BRIGHTNESS = 0.2 // of the softest note, so it is still visible
+)
+
+// levels of velocities 0, 18, 36 ... 127, values in between are interpolated
+type VelocityTable [8]byte
+
+var defaultVelocityTable = VelocityTable{0, 24, 56, 104, 152, 200, 232, 255}
+
+// maps notes (keys) to velocity modes and curves
+var noteToVelocityMode = map[byte]int{
+	KEY_VELOCITY_MODES:     VEL_NONE,
+	KEY_VELOCITY_MODES + 1: VEL_BRIGHTNESS,
+	KEY_VELOCITY_MODES + 2: VEL_HUE,
+	KEY_VELOCITY_MODES + 3: VEL_BOTH,
+}
+var noteToVelocityCurve = map[byte]int{
+	KEY_VELOCITY_CURVES:     CURVE_LINEAR,
+	KEY_VELOCITY_CURVES + 1: CURVE_LOG,
+	KEY_VELOCITY_CURVES + 2: CURVE_TABLE,
+}
+
+// Maps velocity (0-127) to level (0-1) by the curve
+func curveLevel(curve int, table VelocityTable, velocity byte) float64 {
+	v := fromVal(velocity)
+	if v > 1 {
+		v = 1
+	}
+	switch curve {
+	case CURVE_LOG:
+		return math.Log1p(v*127) / math.Log1p(127)
+	case CURVE_TABLE:
+		pos := v * float64(len(table)-1)
+		i := int(pos)
+		if i >= len(table)-1 {
+			return float64(table[len(table)-1]) / 255
+		}
+		frac := pos - float64(i)
+		return (float64(table[i])*(1-frac) + float64(table[i+1])*frac) / 255
+	default:
+		return v
+	}
+}
+
+// level of the velocity by the current curve
+func velocityLevel(velocity byte) float64 {
+	return curveLevel(state.VelocityCurve, state.VelocityTable, velocity)
+}
+
+// hue shift of the note played with the level, zero for middle level
+func velocityHueShift(level float64) int {
+	if state.VelocityMode != VEL_HUE && state.VelocityMode != VEL_BOTH {
+		return 0
+	}
+	return int((level - 0.5) * VELOCITY_HUE_SHIFT)
+}
+
+// dims the color of the note played with the level
+func velocityBrightness(rgb RGB, level float64) RGB {
+	if state.VelocityMode != VEL_BRIGHTNESS && state.VelocityMode != VEL_BOTH {
+		return rgb
+	}
+	return avgColor(BLACK, rgb, VELOCITY_MIN_BRIGHTNESS+(1-VELOCITY_MIN_BRIGHTNESS)*level)
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// VisualizerState are the settings of the leds changed by control keys or http
+type VisualizerState struct {
+	Active         bool          `json:"active"`         // leds react to notes
+	Brightness     byte          `json:"brightness"`     // of wled
+	Saturation     byte          `json:"saturation"`     // of colors
+	ColorMode      int           `json:"colorMode"`      // one of MODE_* constants
+	BackgroundMode int           `json:"backgroundMode"` // one of BKG_* constants
+	SustainMode    bool          `json:"sustainMode"`    // sustained notes fade out
+	VelocityMode   int           `json:"velocityMode"`   // one of VEL_* constants
+	VelocityCurve  int           `json:"velocityCurve"`  // one of CURVE_* constants
+	VelocityTable  VelocityTable `json:"velocityTable"`  // levels of CURVE_TABLE
+	Effect         string        `json:"effect"`         // one of EFFECT_* constants
+	Effects        EffectParams  `json:"effects"`        // parameters of the effects
+}
+
+func defaultVisualizerState() VisualizerState {
+	return VisualizerState{
+		Active:         true,
+		Brightness:     127,
+		Saturation:     255,
+		ColorMode:      MODE_WHITE_WARM,
+		BackgroundMode: BKG_BLACK,
+		SustainMode:    true,
+		VelocityMode:   VEL_NONE,
+		VelocityCurve:  CURVE_LINEAR,
+		VelocityTable:  defaultVelocityTable,
+		Effect:         EFFECT_NONE,
+		Effects:        defaultEffectParams(),
+	}
+}
+
+const STATE_SAVE_DELAY = 3 * time.Second // state is saved when not changed for this long
+
+// Loads saved state, missing file gives the default state
+// missing fields keep their default values
+func loadVisualizerState(path string) (VisualizerState, error) {
+	s := defaultVisualizerState()
+	if path == "" {
+		return s, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return s, fmt.Errorf("failed to read visualizer state: %s", err)
+	}
+	if err := json.Unmarshal(data, &s); err != nil {
+		return defaultVisualizerState(), fmt.Errorf("failed to parse visualizer state: %s", err)
+	}
+	if err := s.validate(); err != nil {
+		return defaultVisualizerState(), err
+	}
+	return s, nil
+}
+
+func saveVisualizerState(path string, s VisualizerState) {
+	if path == "" {
+		return
+	}
+	data, err := json.MarshalIndent(s, "", "\t")
+	if err != nil {
+		log.Println("Can't encode visualizer state", err)
+		return
+	}
+	if err := writeFileAtomic(path, data); err != nil {
+		log.Println("Can't save visualizer state", err)
+	}
+}
+
+func (s VisualizerState) validate() error {
+	if s.ColorMode < MODE_NONE || s.ColorMode > MODE_MAGENTA_RED {
+		return fmt.Errorf("unknown color mode %d", s.ColorMode)
+	}
+	if s.BackgroundMode < BKG_BLACK || s.BackgroundMode > BKG_LIGHT {
+		return fmt.Errorf("unknown background mode %d", s.BackgroundMode)
+	}
+	if s.VelocityMode < VEL_NONE || s.VelocityMode > VEL_BOTH {
+		return fmt.Errorf("unknown velocity mode %d", s.VelocityMode)
+	}
+	if s.VelocityCurve < CURVE_LINEAR || s.VelocityCurve > CURVE_TABLE {
+		return fmt.Errorf("unknown velocity curve %d", s.VelocityCurve)
+	}
+	if !isEffect(s.Effect) {
+		return fmt.Errorf("unknown effect %q", s.Effect)
+	}
+	if err := s.Effects.validate(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Visualizer gives access to the state owned by the wled goroutine
+// every request is run by the goroutine itself
+type Visualizer struct {
+	requests chan func()
+	power    func(bool)            // run by the goroutine
+	apply    func(VisualizerState) // run by the goroutine
+	save     func()                // run by the goroutine
+}
+
+// runs f in the wled goroutine and waits for it
+func (v *Visualizer) do(f func()) {
+	done := make(chan bool)
+	v.requests <- func() {
+		f()
+		close(done)
+	}
+	<-done
+}
+
+// Turns the wled on or off with animation
+func (v *Visualizer) Power(on bool) {
+	v.do(func() {
+		v.power(on)
+	})
+}
+
+// Saves the state now instead of waiting for it to settle, e.g. before exit
+func (v *Visualizer) Save() {
+	v.do(func() {
+		v.save()
+	})
+}
+
+func (v *Visualizer) State() VisualizerState {
+	var s VisualizerState
+	v.do(func() {
+		s = state
+	})
+	return s
+}
+
+func (v *Visualizer) SetState(s VisualizerState) error {
+	if err := s.validate(); err != nil {
+		return err
+	}
+	v.do(func() {
+		v.apply(s)
+	})
+	return nil
+}
+
+// Sets the look of the preset, keeps the wled on or off
+func (v *Visualizer) Apply(p Preset) {
+	v.do(func() {
+		look := p.State
+		look.Active = state.Active
+		v.apply(look)
+	})
+}
+
+// Sets the default state, keeps the wled on or off
+func (v *Visualizer) Reset() {
+	s := defaultVisualizerState()
+	s.Active = v.State().Active
+	v.SetState(s)
+}
+
+// Registers http api for the visualizer state
+func handleVisualizer(r *mux.Router, vis *Visualizer) {
+	r.HandleFunc("/visualizer/state", func(w http.ResponseWriter, r *http.Request) {
+		setupResponse(&w, r)
+		json.NewEncoder(w).Encode(vis.State())
+	}).Methods(http.MethodGet)
+
+	// changes only the fields given
+	r.HandleFunc("/visualizer/state", func(w http.ResponseWriter, r *http.Request) {
+		setupResponse(&w, r)
+		s := vis.State()
+		if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+			http.Error(w, "invalid body", http.StatusBadRequest)
+			return
+		}
+		if err := vis.SetState(s); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(vis.State())
+	}).Methods(http.MethodPut)
+
+	// back to factory defaults
+	r.HandleFunc("/visualizer/reset", func(w http.ResponseWriter, r *http.Request) {
+		setupResponse(&w, r)
+		vis.Reset()
+		json.NewEncoder(w).Encode(vis.State())
+	}).Methods(http.MethodPost)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/gorilla/mux"
+)
+
+const WATCH_SETTLE = time.Second // wait for the file to be completely written before parsing
+
+// Keeps the archive index up to date
+// uses inotify when available, otherwise polls the dir every pollInterval
+func watchArchive(archive *Archive, pollInterval time.Duration) {
+	if _, _, _, err := archive.Refresh(); err != nil {
+		log.Println(err)
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err == nil {
+		err = watchTree(watcher, archive.dir)
+	}
+	if err != nil {
+		log.Println("Can't watch archive, polling instead:", err)
+		if watcher != nil {
+			watcher.Close()
+		}
+		go pollArchive(archive, pollInterval)
+		return
+	}
+
+	go func() {
+		defer watcher.Close()
+		settle := time.NewTimer(WATCH_SETTLE)
+		settle.Stop()
+		for {
+			select {
+			case ev, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if ev.Op&fsnotify.Create != 0 { // watch new YYYY/MM dirs too
+					watchTree(watcher, ev.Name)
+				}
+				// new dir may already contain files created before it was watched
+				if filepath.Ext(ev.Name) == ".mid" || ev.Op&(fsnotify.Create|fsnotify.Remove|fsnotify.Rename) != 0 {
+					settle.Reset(WATCH_SETTLE)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Println("Archive watcher error", err)
+				settle.Reset(WATCH_SETTLE) // events may be lost, rescan
+			case <-settle.C:
+				if _, _, _, err := archive.Refresh(); err != nil {
+					log.Println(err)
+				}
+			}
+		}
+	}()
+}
+
+// adds watches for the dir and all its subdirs
+func watchTree(watcher *fsnotify.Watcher, root string) error {
+	return filepath.WalkDir(root, func(pathname string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if pathname == root {
+				return err
+			}
+			return nil
+		}
+		if d.IsDir() {
+			if err := watcher.Add(pathname); err != nil {
+				return fmt.Errorf("failed to watch %s: %s", pathname, err)
+			}
+		}
+		return nil
+	})
+}
+
+func pollArchive(archive *Archive, interval time.Duration) {
+	for range time.Tick(interval) {
+		if _, _, _, err := archive.Refresh(); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// Registers server-sent events endpoint pushing archive changes
+func handleArchiveEvents(r *mux.Router, archive *Archive) {
+	r.HandleFunc("/archive/events", func(w http.ResponseWriter, r *http.Request) {
+		setupResponse(&w, r)
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming not supported", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		events, unsubscribe := archive.Subscribe()
+		defer unsubscribe()
+		keepAlive := time.NewTicker(30 * time.Second)
+		defer keepAlive.Stop()
+		for {
+			select {
+			case ev := <-events:
+				data, err := json.Marshal(ev)
+				if err != nil {
+					log.Println("Can't encode archive event", err)
+					continue
+				}
+				fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data)
+				flusher.Flush()
+			case <-keepAlive.C:
+				fmt.Fprint(w, ": keep-alive\n\n")
+				flusher.Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}).Methods(http.MethodGet)
+}
@@ -1,59 +1,374 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
 	"log"
-	"net/url"
+	"net/http"
+	"sync"
+	"time"
 
+	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
 )
 
-// Return channel which
-func getWebSocket(addr string) chan []byte {
-	u, _ := url.Parse(addr)
+const (
+	WS_BACKOFF_MIN = time.Second      // first reconnect delay, doubled after every failure
+	WS_BACKOFF_MAX = time.Minute      // longest reconnect delay
+	WS_STABLE      = 30 * time.Second // connection up this long resets the reconnect delay
+	WS_PING        = 20 * time.Second // how often the server is pinged
+	WS_PONG_WAIT   = 45 * time.Second // connection is dropped when nothing is received for this long
+	WS_WRITE_WAIT  = 5 * time.Second
 
+	WS_RECEIVED_SIZE = 256 // received messages waiting for the consumer
+)
+
+// states of the connection
+const (
+	WS_CONNECTING   = "connecting"
+	WS_CONNECTED    = "connected"
+	WS_DISCONNECTED = "disconnected" // waiting for reconnect
+	WS_CLOSED       = "closed"
+)
+
+// releases of notes and pedals are never dropped, not to leave them stuck at the other side
+type wsMessage struct {
+	seq     int64
+	data    []byte
+	at      time.Time // when the message was queued
+	release bool
+}
+
+// WsStatus is the state of websocket client with its counters
+type WsStatus struct {
+	Addr      string    `json:"addr"`
+	State     string    `json:"state"`
+	Since     time.Time `json:"since"` // of the current state
+	LastError string    `json:"lastError,omitempty"`
+	Queued    int       `json:"queued"`
+	Sent      int64     `json:"sent"`
+	Received  int64     `json:"received"`
+	Dropped   int64     `json:"dropped"` // because of full queue
+	Expired   int64     `json:"expired"` // queued for longer than max age, releases are sent anyway
+	Missed    int64     `json:"missed"`  // received but not consumed in time
+	Reconnect int64     `json:"reconnects"`
+}
+
+// WsClient keeps connection to the pianco relay alive
+// messages are queued while disconnected and sent after reconnect
+type WsClient struct {
+	mu       sync.Mutex
+	addr     string
+	size     int           // max queued messages
+	drop     string        // DROP_OLDEST or DROP_NEWEST
+	maxAge   time.Duration // older messages are not sent
+	queue    []wsMessage
+	seq      int64     // of the last queued message
+	signal   chan bool // wakes the writer when something is queued
+	status   WsStatus
+	received chan []byte // incoming messages
+	late     [][]byte    // received releases waiting for room in received, in order
+	lateWake chan bool   // wakes the deliverer of late releases
+	done     chan bool
+
+	backoffMin time.Duration // WS_BACKOFF_MIN and WS_BACKOFF_MAX, unless changed
+	backoffMax time.Duration
+	stable     time.Duration // WS_STABLE, unless changed
+}
+
+// Returns channel which sends messages to the pianco relay
+// and the client for status and incoming messages
+// connection is made in background, so it never fails
+func getWebSocket(cfg PiancoConfig) (chan []byte, *WsClient) {
+	client := newWsClient(cfg.Addr, cfg.QueueSize, cfg.Drop, time.Duration(cfg.MaxAge)*time.Second)
 	messages := make(chan []byte)
+	go func() {
+		for msg := range messages {
+			client.Send(msg)
+		}
+	}()
+	client.Start()
+	return messages, client
+}
+
+func newWsClient(addr string, size int, drop string, maxAge time.Duration) *WsClient {
+	return &WsClient{
+		addr:     addr,
+		size:     size,
+		drop:     drop,
+		maxAge:   maxAge,
+		signal:   make(chan bool, 1),
+		status:   WsStatus{Addr: addr, State: WS_DISCONNECTED, Since: time.Now()},
+		received: make(chan []byte, WS_RECEIVED_SIZE),
+		lateWake: make(chan bool, 1),
+		done:     make(chan bool),
+
+		backoffMin: WS_BACKOFF_MIN,
+		backoffMax: WS_BACKOFF_MAX,
+		stable:     WS_STABLE,
+	}
+}
+
+// Starts connecting in background
+func (c *WsClient) Start() {
+	go c.run()
+	go c.deliverLate()
+}
 
-	var ws *websocket.Conn
-	var err error
-	ws, err = newWs(u.String())
+// Stops the client, queued messages are discarded
+func (c *WsClient) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.status.State == WS_CLOSED {
+		return
+	}
+	close(c.done)
+	c.setState(WS_CLOSED, nil)
+}
+
+// Queues the message, when the queue is full the oldest or the new message is dropped
+// releases are never dropped, the queue grows when it is full of them
+func (c *WsClient) Send(data []byte) {
+	release := isPiancoRelease(data)
+	c.mu.Lock()
+	if len(c.queue) >= c.size {
+		if c.drop == DROP_NEWEST && !release {
+			c.status.Dropped++
+			c.mu.Unlock()
+			return
+		}
+		if i := c.oldestDroppable(); i >= 0 {
+			c.queue = append(c.queue[:i:i], c.queue[i+1:]...)
+			c.status.Dropped++
+		}
+	}
+	c.seq++
+	c.queue = append(c.queue, wsMessage{c.seq, data, time.Now(), release})
+	c.mu.Unlock()
+	select {
+	case c.signal <- true:
+	default:
+	}
+}
+
+// index of the oldest queued message which is not release, -1 if there is none
+// must be called with the lock held
+func (c *WsClient) oldestDroppable() int {
+	for i, msg := range c.queue {
+		if !msg.release {
+			return i
+		}
+	}
+	return -1
+}
+
+// Returns channel of messages received from the relay
+func (c *WsClient) Received() chan []byte {
+	return c.received
+}
+
+func (c *WsClient) Status() WsStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	status := c.status
+	status.Queued = len(c.queue)
+	return status
+}
+
+// must be called with the lock held
+func (c *WsClient) setState(state string, err error) {
+	if c.status.State == WS_CLOSED {
+		return
+	}
+	c.status.State = state
+	c.status.Since = time.Now()
 	if err != nil {
-		log.Fatal("ws dial failed", err)
+		c.status.LastError = err.Error()
 	}
+}
 
-	go func() {
-		for {
-			msg := <-messages
-			err := ws.WriteMessage(websocket.BinaryMessage, msg)
-			if err != nil { // if first write failed, try to re-dial
-				ws, err = newWs(u.String())
-				if err != nil {
-					log.Println("no ws connection, message dropped", err)
-				} else {
-					err := ws.WriteMessage(websocket.BinaryMessage, msg)
-					if err != nil {
-						log.Println("second send try failed", err)
-					}
-				}
+func (c *WsClient) update(state string, err error) {
+	c.mu.Lock()
+	c.setState(state, err)
+	c.mu.Unlock()
+}
+
+// dials and serves connections until closed, waiting longer after every failure
+// the wait is reset only by connection which stayed up for a while,
+// so server dropping every connection is not hit too often
+func (c *WsClient) run() {
+	backoff := c.backoffMin
+	for {
+		c.update(WS_CONNECTING, nil)
+		ws, _, err := websocket.DefaultDialer.Dial(c.addr, nil)
+		if err == nil {
+			log.Println("Ws connected", c.addr)
+			c.update(WS_CONNECTED, nil)
+			connectedAt := time.Now()
+			err = c.serve(ws)
+			log.Println("Ws disconnected", err)
+			if time.Since(connectedAt) >= c.stable {
+				backoff = c.backoffMin
 			}
+		} else {
+			log.Println("Ws dial failed", err)
 		}
-	}()
+		c.update(WS_DISCONNECTED, err)
 
-	return messages
+		select {
+		case <-c.done:
+			return
+		case <-time.After(backoff):
+		}
+		c.mu.Lock()
+		c.status.Reconnect++
+		c.mu.Unlock()
+		backoff *= 2
+		if backoff > c.backoffMax {
+			backoff = c.backoffMax
+		}
+	}
 }
 
-func newWs(url string) (*websocket.Conn, error) {
-	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
-	if err != nil {
-		go readLoop(ws)
+// writes queued messages and pings until the connection fails or client is closed
+func (c *WsClient) serve(ws *websocket.Conn) error {
+	defer ws.Close()
+
+	readErr := make(chan error, 1)
+	go c.readLoop(ws, readErr)
+
+	ping := time.NewTicker(WS_PING)
+	defer ping.Stop()
+	for {
+		if err := c.flush(ws); err != nil {
+			return err
+		}
+		select {
+		case <-c.signal:
+		case <-ping.C:
+			deadline := time.Now().Add(WS_WRITE_WAIT)
+			if err := ws.WriteControl(websocket.PingMessage, nil, deadline); err != nil {
+				return fmt.Errorf("ping failed: %s", err)
+			}
+		case err := <-readErr:
+			return err
+		case <-c.done:
+			ws.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+				time.Now().Add(WS_WRITE_WAIT))
+			return fmt.Errorf("closed")
+		}
 	}
-	return ws, err
 }
 
-func readLoop(c *websocket.Conn) {
+// sends all queued messages, expired ones are dropped
+// failed message stays in queue to be sent after reconnect
+func (c *WsClient) flush(ws *websocket.Conn) error {
 	for {
-		if _, _, err := c.NextReader(); err != nil {
-			c.Close()
-			break
+		c.mu.Lock()
+		if len(c.queue) == 0 {
+			c.mu.Unlock()
+			return nil
+		}
+		msg := c.queue[0]
+		if c.maxAge > 0 && time.Since(msg.at) > c.maxAge && !msg.release {
+			c.queue = c.queue[1:]
+			c.status.Expired++
+			c.mu.Unlock()
+			continue
 		}
+		c.mu.Unlock()
+
+		ws.SetWriteDeadline(time.Now().Add(WS_WRITE_WAIT))
+		if err := ws.WriteMessage(websocket.BinaryMessage, msg.data); err != nil {
+			return fmt.Errorf("write failed: %s", err)
+		}
+
+		c.mu.Lock()
+		if len(c.queue) > 0 && c.queue[0].seq == msg.seq { // not dropped meanwhile
+			c.queue = c.queue[1:]
+		}
+		c.status.Sent++
+		c.mu.Unlock()
 	}
 }
+
+// receives messages, any message or pong keeps the connection alive
+func (c *WsClient) readLoop(ws *websocket.Conn, errc chan error) {
+	ws.SetReadDeadline(time.Now().Add(WS_PONG_WAIT))
+	ws.SetPongHandler(func(string) error {
+		return ws.SetReadDeadline(time.Now().Add(WS_PONG_WAIT))
+	})
+	for {
+		_, data, err := ws.ReadMessage()
+		if err != nil {
+			errc <- fmt.Errorf("read failed: %s", err)
+			return
+		}
+		ws.SetReadDeadline(time.Now().Add(WS_PONG_WAIT))
+		c.mu.Lock()
+		c.status.Received++
+		late := len(c.late) > 0 // later messages can't overtake them
+		c.mu.Unlock()
+		if !late {
+			select {
+			case c.received <- data:
+				continue
+			default:
+			}
+		}
+		// consumer is stuck or nobody listens, don't block the keepalive
+		c.mu.Lock()
+		if isPiancoRelease(data) {
+			c.late = append(c.late, data)
+			c.mu.Unlock()
+			select {
+			case c.lateWake <- true:
+			default:
+			}
+			continue
+		}
+		c.status.Missed++
+		missed := c.status.Missed
+		c.mu.Unlock()
+		if missed&(missed-1) == 0 { // 1st, 2nd, 4th, 8th...
+			log.Println("Ws received messages dropped", missed)
+		}
+	}
+}
+
+// passes late releases to received as soon as there is room
+func (c *WsClient) deliverLate() {
+	for {
+		select {
+		case <-c.lateWake:
+		case <-c.done:
+			return
+		}
+		for {
+			c.mu.Lock()
+			if len(c.late) == 0 {
+				c.mu.Unlock()
+				break
+			}
+			data := c.late[0]
+			c.mu.Unlock()
+			select {
+			case c.received <- data:
+			case <-c.done:
+				return
+			}
+			c.mu.Lock()
+			c.late = c.late[1:] // removed after sent, so nothing overtakes it
+			c.mu.Unlock()
+		}
+	}
+}
+
+// Registers http api for state of the pianco connection
+func handleWebSocket(r *mux.Router, client *WsClient) {
+	r.HandleFunc("/pianco/status", func(w http.ResponseWriter, r *http.Request) {
+		setupResponse(&w, r)
+		json.NewEncoder(w).Encode(client.Status())
+	}).Methods(http.MethodGet)
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// starts relay which passes every connection to serve
+// returns its websocket address
+func testRelay(t *testing.T, serve func(ws *websocket.Conn)) string {
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+		serve(ws)
+	}))
+	t.Cleanup(srv.Close)
+	return "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+// reads messages until the connection fails
+func readAll(ws *websocket.Conn, messages chan string) {
+	for {
+		_, data, err := ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		messages <- string(data)
+	}
+}
+
+func expectMessage(t *testing.T, messages chan string, want string) {
+	t.Helper()
+	select {
+	case got := <-messages:
+		if got != want {
+			t.Fatalf("got message %q, want %q", got, want)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("message %q not received", want)
+	}
+}
+
+func TestWsQueueOverflow(t *testing.T) {
+	tests := []struct {
+		drop string
+		want []string
+	}{
+		{DROP_OLDEST, []string{"3", "4", "5"}},
+		{DROP_NEWEST, []string{"1", "2", "3"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.drop, func(t *testing.T) {
+			c := newWsClient("ws://unused", 3, tt.drop, 0)
+			for _, msg := range []string{"1", "2", "3", "4", "5"} {
+				c.Send([]byte(msg))
+			}
+			got := []string{}
+			for _, msg := range c.queue {
+				got = append(got, string(msg.data))
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("queued %v, want %v", got, tt.want)
+			}
+			if status := c.Status(); status.Dropped != 2 || status.Queued != 3 {
+				t.Errorf("dropped %d queued %d, want 2 and 3", status.Dropped, status.Queued)
+			}
+		})
+	}
+}
+
+func TestWsExpiredNotSent(t *testing.T) {
+	messages := make(chan string, 10)
+	addr := testRelay(t, func(ws *websocket.Conn) {
+		readAll(ws, messages)
+	})
+	c := newWsClient(addr, 10, DROP_OLDEST, 50*time.Millisecond)
+	defer c.Close()
+	c.Send([]byte("old"))
+	time.Sleep(100 * time.Millisecond)
+	c.Send([]byte("fresh"))
+	c.Start()
+
+	expectMessage(t, messages, "fresh")
+	if status := c.Status(); status.Expired != 1 || status.Sent != 1 {
+		t.Errorf("expired %d sent %d, want 1 and 1", status.Expired, status.Sent)
+	}
+}
+
+func TestWsReconnect(t *testing.T) {
+	messages := make(chan string, 10)
+	connections := 0
+	addr := testRelay(t, func(ws *websocket.Conn) {
+		connections++
+		if connections == 1 { // first connection is dropped after single message
+			_, data, err := ws.ReadMessage()
+			if err == nil {
+				messages <- string(data)
+			}
+			return
+		}
+		readAll(ws, messages)
+	})
+	c := newWsClient(addr, 10, DROP_OLDEST, 0)
+	c.backoffMin = 10 * time.Millisecond
+	defer c.Close()
+	c.Start()
+
+	c.Send([]byte("first"))
+	expectMessage(t, messages, "first")
+	// message queued while disconnected is sent after reconnect
+	deadline := time.Now().Add(2 * time.Second)
+	for c.Status().Reconnect == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	c.Send([]byte("second"))
+	expectMessage(t, messages, "second")
+	if status := c.Status(); status.Reconnect < 1 {
+		t.Errorf("reconnects %d, want at least 1", status.Reconnect)
+	}
+}
+
+func TestWsBackoff(t *testing.T) {
+	const min = 50 * time.Millisecond
+	tests := []struct {
+		name   string
+		stable time.Duration
+		check  func(t *testing.T, gaps []time.Duration)
+	}{
+		{"grows when dropped at once", time.Hour, func(t *testing.T, gaps []time.Duration) {
+			for i, gap := range gaps {
+				if want := min << uint(i); gap < want {
+					t.Errorf("reconnect %d after %v, want at least %v", i+1, gap, want)
+				}
+			}
+		}},
+		{"resets after stable connection", 0, func(t *testing.T, gaps []time.Duration) {
+			for i, gap := range gaps {
+				if gap >= 3*min {
+					t.Errorf("reconnect %d after %v, want about %v", i+1, gap, min)
+				}
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			accepted := make(chan time.Time, 10)
+			addr := testRelay(t, func(ws *websocket.Conn) {
+				accepted <- time.Now() // and drop the connection
+			})
+			c := newWsClient(addr, 10, DROP_OLDEST, 0)
+			c.backoffMin = min
+			c.backoffMax = time.Second
+			c.stable = tt.stable
+			defer c.Close()
+			c.Start()
+
+			times := []time.Time{}
+			for len(times) < 4 {
+				select {
+				case at := <-accepted:
+					times = append(times, at)
+				case <-time.After(3 * time.Second):
+					t.Fatalf("only %d connections", len(times))
+				}
+			}
+			gaps := []time.Duration{}
+			for i := 1; i < len(times); i++ {
+				gaps = append(gaps, times[i].Sub(times[i-1]))
+			}
+			tt.check(t, gaps)
+		})
+	}
+}
+
+func TestWsMissedCounted(t *testing.T) {
+	addr := testRelay(t, func(ws *websocket.Conn) {
+		for i := 0; i < WS_RECEIVED_SIZE+5; i++ {
+			ws.WriteMessage(websocket.BinaryMessage, []byte{byte(i)})
+		}
+		time.Sleep(time.Second)
+	})
+	c := newWsClient(addr, 10, DROP_OLDEST, 0)
+	defer c.Close()
+	c.Start()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for c.Status().Received < WS_RECEIVED_SIZE+5 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if status := c.Status(); status.Missed != 5 {
+		t.Errorf("missed %d, want 5", status.Missed)
+	}
+	if got := len(c.Received()); got != WS_RECEIVED_SIZE {
+		t.Errorf("%d messages waiting, want %d", got, WS_RECEIVED_SIZE)
+	}
+}
+
+func TestWsReleasesNotDropped(t *testing.T) {
+	on := func(key byte) []byte { return encodePianco(0, 1, Event{Cmd: CMD_NOTE_ON, Key: key, Value: 100}) }
+	off := func(key byte) []byte { return encodePianco(0, 1, Event{Cmd: CMD_NOTE_OFF, Key: key}) }
+	pedalUp := encodePianco(0, 1, Event{Cmd: CMD_CONTROL_CHANGE, Key: CC_SUTAIN, Value: 0})
+	tests := []struct {
+		name    string
+		drop    string
+		size    int
+		send    [][]byte
+		want    [][]byte
+		dropped int64
+	}{
+		{"oldest", DROP_OLDEST, 2, [][]byte{on(60), off(60), on(61), off(61)}, [][]byte{off(60), off(61)}, 2},
+		{"newest", DROP_NEWEST, 2, [][]byte{on(60), off(60), on(61), off(61)}, [][]byte{off(60), off(61)}, 2},
+		{"full of releases grows", DROP_OLDEST, 1, [][]byte{off(60), pedalUp}, [][]byte{off(60), pedalUp}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newWsClient("ws://unused", tt.size, tt.drop, 0)
+			for _, msg := range tt.send {
+				c.Send(msg)
+			}
+			got := [][]byte{}
+			for _, msg := range c.queue {
+				got = append(got, msg.data)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("queued % x, want % x", got, tt.want)
+			}
+			if dropped := c.Status().Dropped; dropped != tt.dropped {
+				t.Errorf("dropped %d, want %d", dropped, tt.dropped)
+			}
+		})
+	}
+}
+
+func TestWsExpiredReleaseSent(t *testing.T) {
+	messages := make(chan string, 10)
+	addr := testRelay(t, func(ws *websocket.Conn) {
+		readAll(ws, messages)
+	})
+	release := encodePianco(0, 1, Event{Cmd: CMD_NOTE_OFF, Key: 60})
+	c := newWsClient(addr, 10, DROP_OLDEST, 50*time.Millisecond)
+	defer c.Close()
+	c.Send([]byte("old"))
+	c.Send(release)
+	time.Sleep(100 * time.Millisecond)
+	c.Start()
+
+	expectMessage(t, messages, string(release))
+	if status := c.Status(); status.Expired != 1 || status.Sent != 1 {
+		t.Errorf("expired %d sent %d, want 1 and 1", status.Expired, status.Sent)
+	}
+}
+
+func TestWsReceivedReleasesNotMissed(t *testing.T) {
+	release := func(key byte) []byte { return encodePianco(0, 1, Event{Cmd: CMD_NOTE_OFF, Key: key}) }
+	addr := testRelay(t, func(ws *websocket.Conn) {
+		for i := 0; i < WS_RECEIVED_SIZE; i++ {
+			ws.WriteMessage(websocket.BinaryMessage, []byte{byte(i)})
+		}
+		ws.WriteMessage(websocket.BinaryMessage, release(60))
+		ws.WriteMessage(websocket.BinaryMessage, []byte("missed"))
+		ws.WriteMessage(websocket.BinaryMessage, release(61))
+		time.Sleep(time.Second)
+	})
+	c := newWsClient(addr, 10, DROP_OLDEST, 0)
+	defer c.Close()
+	c.Start()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for c.Status().Received < WS_RECEIVED_SIZE+3 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	for i := 0; i < WS_RECEIVED_SIZE; i++ {
+		<-c.Received()
+	}
+	for _, want := range [][]byte{release(60), release(61)} { // in order, after the earlier ones
+		select {
+		case got := <-c.Received():
+			if !bytes.Equal(got, want) {
+				t.Errorf("received % x, want % x", got, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("release % x not received", want)
+		}
+	}
+	if status := c.Status(); status.Missed != 1 {
+		t.Errorf("missed %d, want 1", status.Missed)
+	}
+}
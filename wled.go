@@ -7,9 +7,7 @@ import (
 	"io/ioutil"
 	"log"
 	"math"
-	"net"
 	"net/http"
-	"strings"
 	"time"
 )
 
@@ -23,7 +21,7 @@ const (
 const (
 	_ = iota
 	WARLS
-	DRGB // only supporeted now
+	DRGB
 	DRGBW
 	DNRGB
 )
@@ -68,6 +66,15 @@ const (
 	KEY_INC_SAT
 )
 
+// ranges of keys switching the look while control keys are pressed
+// color modes take keys A0+8 to A0+26, the rest is reserved here
+const (
+	KEY_VELOCITY_MODES  = NOTE_A0 + 27 // 4 keys
+	KEY_VELOCITY_CURVES = NOTE_A0 + 32 // 3 keys
+	KEY_NEXT_EFFECT     = NOTE_A0 + 35
+	KEY_PRESET_1        = NOTE_A0 + 36 // presets take all keys up to C8
+)
+
 // maps notes (keys) to color modes
 var noteToColorMode = map[byte]int{
 	NOTE_A0 + 9:  MODE_WHITE_COLD,
@@ -104,36 +111,17 @@ var (
 	BLUE       = RGB{0, 0, 255}
 )
 
-var ctrl = [2]bool{false, false} // fisrt 2 white keys for controlls
-var (
-	doDecSat                     = false
-	doIncSat                     = false
-	doDecBri                     = false
-	doIncBri                     = false
-	pressingOffTimer *time.Timer = nil
-)
-
-// state
-var state = struct {
-	active         bool
-	brightness     byte
-	saturation     byte
-	colorMode      int
-	backgroundMode int
-	sustainMode    bool
-}{
-	active:         true,
-	brightness:     127,
-	saturation:     255,
-	colorMode:      MODE_WHITE_WARM,
-	backgroundMode: BKG_BLACK,
-	sustainMode:    true,
-}
+// state of the visualizer, owned by the wled goroutine
+// others access it through Visualizer
+var state = defaultVisualizerState()
 
 type Note struct {
 	on  bool      // true if note is pressed down
 	sus bool      // true if note is sustained
+	sos bool      // true if note is held by sostenuto pedal
 	t   time.Time // time of when it was pressed
+	vel byte      // velocity it was pressed with
+	rgb *RGB      // colour of remote user, nil for the color mode
 }
 type Notes map[byte]Note
 
@@ -143,38 +131,86 @@ type Leds struct {
 	ledPerNote int    // number of leds per single key (note) (2)
 	firstLed   int    // index of first led on the strip to be lit (1)
 	firstNote  int    // midi value of first note to be lit (21)
+	reversed   bool   // whether the strip starts at the last led of the buffer
 	sustain    bool   // whehter the sustain is now on or off
+	sostenuto  bool   // whehter the sostenuto is now on or off
 	notes      Notes
+	keyMap     *KeyMap // calibrated ranges overriding the uniform layout
+	effect     Effect  // animation on top of the notes, nil for none
 }
 
-func newLeds(keys int, ledPerNote int, firstLed int, firstNote int) Leds {
-	buffer := make([]byte, (firstLed+(keys*ledPerNote))*3)
+// count is total leds on the strip, zero to fit the keys exactly
+func newLeds(keys int, ledPerNote int, firstLed int, firstNote int, count int, reversed bool) Leds {
+	if count == 0 {
+		count = firstLed + keys*ledPerNote
+	}
+	buffer := make([]byte, count*3)
 	return Leds{
 		buffer:     buffer,
 		keys:       keys,
 		ledPerNote: ledPerNote,
 		firstLed:   firstLed,
 		firstNote:  firstNote,
+		reversed:   reversed,
 		sustain:    false,
 		notes:      make(Notes, keys),
 	}
 }
 
-func (leds Leds) set(note byte, rgb RGB) {
+// Returns leds lit by the note, either calibrated or by uniform layout
+func (leds Leds) ledRange(note byte) LedRange {
+	if r, ok := leds.keyMap.Get(note); ok {
+		return r
+	}
 	keyIndex := int(note) - leds.firstNote
-	ledIndex := leds.firstLed + keyIndex*leds.ledPerNote
-	for i := ledIndex * 3; i < (ledIndex+leds.ledPerNote)*3; i++ {
-		leds.buffer[i] = rgb[i%3]
+	return LedRange{leds.firstLed + keyIndex*leds.ledPerNote, leds.ledPerNote}
+}
+
+func (leds Leds) set(note byte, rgb RGB) {
+	r := leds.ledRange(note)
+	for i := r.First; i < r.First+r.Count; i++ {
+		leds.setLed(i, rgb)
 	}
 }
 
+// set color of single led, index is counted from the start of the strip
+// or from its end if the strip is reversed
+func (leds Leds) setLed(index int, rgb RGB) {
+	if leds.reversed {
+		index = len(leds.buffer)/3 - 1 - index
+	}
+	if index < 0 || index >= len(leds.buffer)/3 {
+		return
+	}
+	copy(leds.buffer[index*3:index*3+3], rgb[:])
+}
+
 func (leds Leds) On(note byte, velocity byte) {
-	leds.set(note, noteToColor(note, velocity))
-	leds.notes[note] = Note{true, false, time.Now()}
+	rgb := noteToColor(note, velocity)
+	leds.set(note, rgb)
+	leds.notes[note] = Note{on: true, sos: leds.notes[note].sos, t: time.Now(), vel: velocity}
+	if leds.effect != nil {
+		leds.effect.Note(note, rgb, velocity, time.Now())
+	}
+}
+
+// lit the note by given colour instead of the color mode
+func (leds Leds) OnColor(note byte, rgb RGB) {
+	leds.set(note, rgb)
+	leds.notes[note] = Note{on: true, sos: leds.notes[note].sos, t: time.Now(), vel: toVal(1), rgb: &rgb}
+	if leds.effect != nil {
+		leds.effect.Note(note, rgb, toVal(1), time.Now())
+	}
 }
 func (leds Leds) Off(note byte) {
-	leds.set(note, noteToBkgColor(note))
-	leds.notes[note] = Note{false, leds.sustain, leds.notes[note].t}
+	held := leds.notes[note].sos
+	if !held {
+		leds.set(note, noteToBkgColor(note))
+	}
+	if leds.effect != nil {
+		leds.effect.Note(note, BLACK, 0, time.Now())
+	}
+	leds.notes[note] = Note{on: false, sus: leds.sustain, sos: held, t: leds.notes[note].t, vel: leds.notes[note].vel, rgb: leds.notes[note].rgb}
 
 }
 func (leds *Leds) Sustain(val byte) {
@@ -186,23 +222,69 @@ func (leds *Leds) Sustain(val byte) {
 		}
 	}
 }
-func (leds *Leds) Render() {
-	now := time.Now()
+
+// only notes pressed when the pedal goes down are held by it
+// half pedal values don't latch notes pressed after the pedal went down
+func (leds *Leds) Sostenuto(val byte) {
+	down := val > 0
+	if down == leds.sostenuto { // only the edges matter
+		return
+	}
+	leds.sostenuto = down // track state of the sostenuto pedal
+	for midi, note := range leds.notes {
+		if leds.sostenuto {
+			note.sos = note.on
+		} else if note.sos { // release held notes
+			note.sos = false
+			if !note.on {
+				note.sus = leds.sustain
+				if !note.sus {
+					leds.set(midi, noteToBkgColor(midi))
+				}
+			}
+		}
+		leds.notes[midi] = note
+	}
+}
+
+// Draws the notes as they look at the time, with the effect on top of them
+func (leds *Leds) Render(now time.Time) {
+	frame := newFrame(leds.firstNote, leds.keys)
+	if leds.effect != nil { // effect may be anywhere, draw all keys
+		leds.effect.Render(frame, now)
+		for i := range frame.Colors {
+			note := byte(i + leds.firstNote)
+			if _, ok := leds.notes[note]; !ok {
+				leds.set(note, addColor(noteToBkgColor(note), frame.At(int(note))))
+			}
+		}
+	}
 	for midi, note := range leds.notes {
-		color := noteToColor(midi, toVal(1))
+		color := noteToColor(midi, note.vel)
+		if note.rgb != nil {
+			color = *note.rgb
+		}
 		bColor := noteToBkgColor(midi)
 		duration := now.Sub(note.t)
 		t := float64(duration) / float64(time.Second*SUSTAIN_DURATION) // 0..1
-		if note.on {
-			leds.set(midi, color)
+		effect := frame.At(int(midi))
+		if note.on || note.sos {
+			leds.set(midi, addColor(color, effect))
 		} else if note.sus && t < 1 {
-			leds.set(midi, avgColor(color, bColor, t))
+			leds.set(midi, addColor(avgColor(color, bColor, t), effect))
 		} else {
-			leds.set(midi, bColor)
+			leds.set(midi, addColor(bColor, effect))
 			delete(leds.notes, midi)
 		}
 	}
 }
+
+// Turns off every led including those outside of the keys
+func (leds *Leds) Clear() {
+	for i := range leds.buffer {
+		leds.buffer[i] = 0
+	}
+}
 func (leds *Leds) Reset() {
 	// leds.buffer = make([]byte, len(leds.buffer))
 	for i := 0; i < leds.keys; i++ {
@@ -212,23 +294,45 @@ func (leds *Leds) Reset() {
 	}
 }
 
-// Returns a channel which consumes midi messages
-// and function for turning the wled on/off
-func getWled(addr string) (chan []byte, func(bool)) {
-	var conn net.Conn
-	var err error
-
-	// 88 keys, two leds per key, skip first led, first note is A0
-	var leds = newLeds(88, 2, 1, NOTE_A0)
+// Returns a channel which consumes midi events
+// and the visualizer for turning the wled on/off and changing its state
+// addr is base url of wled json api, leds are sent via transport
+// presets are recalled by control keys
+func getWled(addr string, transport LedTransport, layout LedsConfig, keyMap *KeyMap, presets *Presets) (chan Event, *Visualizer) {
+	var leds = newLeds(layout.Keys, layout.PerKey, layout.FirstLed, layout.FirstNote, layout.Count, layout.Reversed)
+	leds.keyMap = keyMap
+	keyMapVersion := keyMap.Version()
+	calibratedNote := -1 // note being calibrated
 	// use different view to access idnividual leds of the 'on/off controll area'
-	var subleds = Leds{leds.buffer, 8, 1, 0, 0, false, leds.notes}
+	var subleds = Leds{
+		buffer:     leds.buffer,
+		keys:       8,
+		ledPerNote: 1,
+		reversed:   leds.reversed,
+		notes:      leds.notes,
+	}
 
-	incommingMidi := make(chan []byte)
+	incommingMidi := make(chan Event)
+	vis := &Visualizer{requests: make(chan func())}
 
-	conn, err = net.Dial("udp", addr)
-	if err != nil {
-		log.Fatal("wled dial failed", err)
+	var err error
+	if state, err = loadVisualizerState(layout.State); err != nil {
+		log.Println("Visualizer state not restored:", err)
 	}
+	savedState := state
+	var saveState <-chan time.Time // fires when state is not changed for a while
+
+	effectName, effectParams := "", EffectParams{} // of the running effect, rebuilt when state changes
+
+	ctrl := [2]bool{false, false} // fisrt 2 white keys for controlls
+	var (
+		doDecSat                          = false
+		doIncSat                          = false
+		doDecBri                          = false
+		doIncBri                          = false
+		pressingOffTimer *time.Timer      = nil
+		pressingOff      <-chan time.Time = nil // fires when toggle key is held long
+	)
 
 	ticker := time.NewTicker(time.Second / FPS)
 
@@ -237,22 +341,12 @@ func getWled(addr string) (chan []byte, func(bool)) {
 		if len(args) > 0 {
 			wait = args[0]
 		}
-		if state.sustainMode && len(args) > 1 { // rerender buffer
-			leds.Render()
+		if (state.SustainMode || leds.effect != nil) && len(args) > 1 { // rerender buffer
+			leds.Render(time.Now())
 		}
 
-		_, err = conn.Write(append([]byte{DRGB, wait}, leds.buffer...))
-		if err != nil {
-			// try redial
-			conn, err = net.Dial("udp", addr)
-			if err != nil {
-				log.Println("no udp connection, message dropped", err)
-			} else {
-				_, err = conn.Write(append([]byte{DRGB, wait}, leds.buffer...))
-				if err != nil {
-					log.Println("second send try failed", err)
-				}
-			}
+		if err := transport.Send(leds.buffer, wait); err != nil {
+			log.Println("leds not sent, message dropped", err)
 		}
 	}
 
@@ -280,44 +374,94 @@ func getWled(addr string) (chan []byte, func(bool)) {
 		}
 	}
 
+	// velocity rises from the lowest key to the highest
+	previewVelocity := func() {
+		for i := 0; i < leds.keys; i++ {
+			note := byte(i + leds.firstNote)
+			velocity := byte(1 + i*126/leds.keys)
+			leds.set(note, noteToColor(note, velocity))
+		}
+	}
+
 	incSat := func(step byte) {
-		if state.saturation <= 255-step {
-			state.saturation += step
+		if state.Saturation <= 255-step {
+			state.Saturation += step
 		}
 		preview()
 	}
 
 	decSat := func(step byte) {
-		if state.saturation >= step+64 {
-			state.saturation -= step
+		if state.Saturation >= step+64 {
+			state.Saturation -= step
 		}
 		preview()
 	}
 
 	incBri := func(step byte) {
-		if state.brightness <= 255-step {
-			state.brightness += step
+		if state.Brightness <= 255-step {
+			state.Brightness += step
 		}
-		setWledState(addr, "bri", state.brightness)
+		setWledState(addr, "bri", state.Brightness)
 		preview()
 	}
 
 	decBri := func(step byte) {
-		if state.brightness >= step+8 {
-			state.brightness -= step
+		if state.Brightness >= step+8 {
+			state.Brightness -= step
 		}
-		setWledState(addr, "bri", state.brightness)
+		setWledState(addr, "bri", state.Brightness)
 		preview()
 	}
 
+	// light the calibrated note and dim its neighbours to see the overlaps
+	showCalibration := func() {
+		leds.Clear()
+		for note := range leds.notes {
+			delete(leds.notes, note)
+		}
+		if calibratedNote < 0 {
+			return
+		}
+		note := byte(calibratedNote)
+		leds.set(note-1, dimmedColor(RED))
+		leds.set(note+1, dimmedColor(RED))
+		leds.set(note, GREEN)
+	}
+
+	// pressing a key selects it, control keys move or resize its range
+	calibrate := func(note byte) {
+		r := leds.ledRange(byte(calibratedNote))
+		switch {
+		case calibratedNote < 0:
+		case note == KEY_DEC_BRI && r.First > 0:
+			r.First--
+		case note == KEY_INC_BRI:
+			r.First++
+		case note == KEY_DEC_SAT && r.Count > 1:
+			r.Count--
+		case note == KEY_INC_SAT:
+			r.Count++
+		default:
+			calibratedNote = -1
+		}
+		if calibratedNote < 0 {
+			calibratedNote = int(note)
+		} else if err := keyMap.Set(byte(calibratedNote), r); err != nil {
+			log.Println("calibration not saved", err)
+		}
+		keyMapVersion = keyMap.Version()
+		showCalibration()
+		sendLeds()
+	}
+
 	animateOn := func() {
 		done := make(chan bool)
-		bkgMode := state.backgroundMode // temporaryly change bkg mode to turn all light off
-		state.backgroundMode = BKG_BLACK
+		bkgMode := state.BackgroundMode // temporaryly change bkg mode to turn all light off
+		state.BackgroundMode = BKG_BLACK
 		leds.Reset()
-		state.backgroundMode = bkgMode
+		state.BackgroundMode = bkgMode
 		go func() {
-			for bri := 15; bri < int(state.brightness); bri += 16 {
+			for bri := 15; bri < int(state.Brightness); bri += 16 {
 				setWledState(addr, "bri", bri)
 				time.Sleep(time.Second / 40)
 			}
@@ -341,18 +485,18 @@ func getWled(addr string) (chan []byte, func(bool)) {
 			sendLeds()
 			time.Sleep(time.Second / 10)
 		}
-		state.backgroundMode = BKG_BLACK
+		state.BackgroundMode = BKG_BLACK
 		subleds.Reset()
 		<-done
-		state.backgroundMode = bkgMode
+		state.BackgroundMode = bkgMode
 		leds.Reset()
 		sendLeds()
 	}
 	animateOff := func() {
 		done := make(chan bool)
-		bkgMode := state.backgroundMode // temporaryly change bkg mode to turn all light off
+		bkgMode := state.BackgroundMode // temporaryly change bkg mode to turn all light off
 		go func() {
-			for bri := int(state.brightness); bri > 15; bri -= 16 {
+			for bri := int(state.Brightness); bri > 15; bri -= 16 {
 				setWledState(addr, "bri", bri)
 				time.Sleep(time.Second / 40)
 			}
@@ -373,33 +517,60 @@ func getWled(addr string) (chan []byte, func(bool)) {
 			sendLeds()
 			time.Sleep(time.Second / 10)
 		}
-		state.backgroundMode = BKG_BLACK
+		state.BackgroundMode = BKG_BLACK
 		subleds.Reset()
 		<-done
 		leds.Reset()
 		sendLeds(1) // leave realtime mode soon
-		state.backgroundMode = bkgMode
+		state.BackgroundMode = bkgMode
 	}
 
 	go func() {
-		defer conn.Close()
+		defer transport.Close()
 		sendLeds()
 		for {
 			select {
-			case msg := <-incommingMidi:
-				cmd := fromCmd(msg[0])
-				note := msg[1]
+			case ev := <-incommingMidi:
+				cmd := ev.Cmd
+				note := ev.Key
+				if keyMap.Calibrating() { // only keys played here calibrate, others are ignored
+					if cmd == CMD_NOTE_ON && ev.Source == SRC_INPUT {
+						calibrate(note)
+					}
+					continue
+				}
+				if ev.Source != SRC_INPUT { // remote players and playback only light their notes, never control
+					if state.Active {
+						switch {
+						case cmd == CMD_NOTE_ON && ev.Source == SRC_REMOTE && config.Pianco.UserColors:
+							leds.OnColor(note, userColor(ev.User))
+						case cmd == CMD_NOTE_ON:
+							leds.On(note, ev.Value)
+						case cmd == CMD_NOTE_OFF:
+							leds.Off(note)
+						case cmd == CMD_CONTROL_CHANGE && note == CC_SUTAIN && ev.Source == SRC_PLAYBACK:
+							leds.Sustain(ev.Value)
+						case cmd == CMD_CONTROL_CHANGE && note == CC_SOSTENUTO && ev.Source == SRC_PLAYBACK:
+							leds.Sostenuto(ev.Value)
+						}
+						sendLeds()
+					}
+					continue
+				}
 				if cmd == CMD_CONTROL_CHANGE && note == CC_SUTAIN {
-					on := msg[2]
+					on := ev.Value
 					leds.Sustain(on)
 					if ctrl[0] && ctrl[1] && on == 0 { // controlls are pressed and pedal release
 						// toggle sustainmode
-						state.sustainMode = !state.sustainMode
+						state.SustainMode = !state.SustainMode
 					}
 				}
+				if cmd == CMD_CONTROL_CHANGE && note == CC_SOSTENUTO {
+					leds.Sostenuto(ev.Value)
+				}
 				if cmd == CMD_NOTE_ON {
-					velocity := msg[2]
-					if state.active {
+					velocity := ev.Value
+					if state.Active {
 						leds.On(note, velocity)
 					}
 					// controll
@@ -407,10 +578,10 @@ func getWled(addr string) (chan []byte, func(bool)) {
 					ctrl[1] = ctrl[1] || note == KEY_CTRL_1
 					if ctrl[0] && ctrl[1] { // controlls are pressed
 						if note == KEY_TOGGLE_ACTIVE && pressingOffTimer == nil { // toggle on/off
-							on := getWledState(addr, "on").(bool)
-							state.active = state.active && on
-							state.active = !state.active
-							if state.active {
+							on, _ := getWledState(addr, "on").(bool)
+							state.Active = state.Active && on
+							state.Active = !state.Active
+							if state.Active {
 								if !on {
 									setWledState(addr, "on", true)
 									animateOn()
@@ -419,19 +590,15 @@ func getWled(addr string) (chan []byte, func(bool)) {
 								leds.Reset()
 								sendLeds(2) // leave realtime mode early
 							}
-							if on {
-								pressingOffTimer = time.AfterFunc(time.Second, func() {
-									state.active = false
-									animateOff()
-									setWledState(addr, "on", false)
-									pressingOffTimer = nil
-								})
+							if on { // long press turns wled off
+								pressingOffTimer = time.NewTimer(time.Second)
+								pressingOff = pressingOffTimer.C
 							}
 						}
-						if state.active { // handle key shortucs binding
+						if state.Active { // handle key shortucs binding
 							switch note {
 							case KEY_TOGGLE_BACKGROUND:
-								state.backgroundMode = (state.backgroundMode + 1) % 3
+								state.BackgroundMode = (state.BackgroundMode + 1) % 3
 								leds.Reset()
 							case KEY_DEC_SAT:
 								doDecSat = true
@@ -448,12 +615,33 @@ func getWled(addr string) (chan []byte, func(bool)) {
 							}
 							for key, mode := range noteToColorMode { // changing color mode
 								if key == note {
-									state.colorMode = mode
+									state.ColorMode = mode
 									preview(true)
 								}
 							}
+							if mode, ok := noteToVelocityMode[note]; ok {
+								state.VelocityMode = mode
+								previewVelocity()
+							}
+							if curve, ok := noteToVelocityCurve[note]; ok {
+								state.VelocityCurve = curve
+								previewVelocity()
+							}
+							if note == KEY_NEXT_EFFECT {
+								for i, name := range effectNames {
+									if name == state.Effect {
+										state.Effect = effectNames[(i+1)%len(effectNames)]
+										break
+									}
+								}
+							}
+							if p, ok := presets.ByKey(note); ok { // recall own look
+								look := p.State
+								look.Active = state.Active
+								vis.apply(look)
+							}
 						} else { // change favourite presets
-							on := getWledState(addr, "on").(bool)
+							on, _ := getWledState(addr, "on").(bool)
 							psId := int(note) - (NOTE_A0 + 3) + 1
 							if on && psId > 0 {
 								setWledState(addr, "ps", psId)
@@ -462,7 +650,7 @@ func getWled(addr string) (chan []byte, func(bool)) {
 					}
 				}
 				if cmd == CMD_NOTE_OFF {
-					if state.active {
+					if state.Active {
 						leds.Off(note)
 					}
 					// controlls
@@ -471,10 +659,10 @@ func getWled(addr string) (chan []byte, func(bool)) {
 
 					if note == KEY_TOGGLE_ACTIVE && pressingOffTimer != nil {
 						pressingOffTimer.Stop()
-						pressingOffTimer = nil
+						pressingOffTimer, pressingOff = nil, nil
 						sendLeds(0) // leave realtime mode immideately
 					}
-					if state.active && ctrl[0] && ctrl[1] {
+					if state.Active && ctrl[0] && ctrl[1] {
 						if doDecSat && note == KEY_DEC_SAT || doIncSat && note == KEY_INC_SAT ||
 							doDecBri && note == KEY_DEC_BRI || doIncBri && note == KEY_INC_BRI {
 							doDecSat = false
@@ -486,18 +674,59 @@ func getWled(addr string) (chan []byte, func(bool)) {
 						}
 
 						for key, mode := range noteToColorMode {
-							if mode == state.colorMode && key == note {
+							if mode == state.ColorMode && key == note {
 								leds.Reset()
 								sendLeds()
 							}
 						}
+						_, velMode := noteToVelocityMode[note]
+						_, velCurve := noteToVelocityCurve[note]
+						if velMode || velCurve {
+							leds.Reset()
+							sendLeds()
+						}
 					}
 				}
-				if state.active {
+				if state.Active {
 					sendLeds()
 				}
 
+			case <-pressingOff:
+				state.Active = false
+				animateOff()
+				setWledState(addr, "on", false)
+				pressingOffTimer, pressingOff = nil, nil
+
+			case request := <-vis.requests:
+				request()
+
+			case <-saveState:
+				saveState = nil
+				saveVisualizerState(layout.State, state)
+
 			case t := <-ticker.C:
+				if state != savedState { // changed by keys or api
+					savedState = state
+					saveState = time.After(STATE_SAVE_DELAY)
+				}
+				if keyMap.Calibrating() { // effect would draw over calibrated keys
+					leds.effect, effectName = nil, ""
+				} else if state.Effect != effectName || state.Effects != effectParams {
+					effectName, effectParams = state.Effect, state.Effects
+					leds.effect = newEffect(effectName, effectParams, leds.firstNote, leds.keys)
+					leds.Reset()
+				}
+				if v := keyMap.Version(); v != keyMapVersion { // ranges changed, redraw all
+					keyMapVersion = v
+					if keyMap.Calibrating() {
+						showCalibration()
+					} else {
+						calibratedNote = -1
+						leds.Clear()
+						leds.Reset()
+					}
+					sendLeds()
+				}
 				isEmpty := true
 				for _, val := range leds.buffer {
 					if val != 0 {
@@ -509,6 +738,9 @@ func getWled(addr string) (chan []byte, func(bool)) {
 						isEmpty = false
 					}
 				}
+				if leds.effect != nil && leds.effect.Busy(t) {
+					isEmpty = false
+				}
 				frag := (int(t.Nanosecond()/1000000) % 1000) / FPS
 				if frag/8 == 0 { // 8 sat steps per second
 					switch {
@@ -526,7 +758,7 @@ func getWled(addr string) (chan []byte, func(bool)) {
 						incBri(4)
 					}
 				}
-				if !isEmpty && state.active {
+				if !isEmpty && state.Active {
 					sendLeds(WAIT, 0)
 				}
 			}
@@ -534,30 +766,55 @@ func getWled(addr string) (chan []byte, func(bool)) {
 		}
 	}()
 
-	power := func(doOn bool) {
-		on := getWledState(addr, "on").(bool)
-		state.active = state.active && on
-		if !state.active && doOn { // turn on
-			state.active = true
+	vis.power = func(doOn bool) {
+		on, _ := getWledState(addr, "on").(bool) // false when wled is unreachable
+		state.Active = state.Active && on
+		if !state.Active && doOn { // turn on
+			state.Active = true
 			setWledState(addr, "on", true)
 			animateOn()
 		}
-		if state.active && !doOn { // turn off
+		if state.Active && !doOn { // turn off
 			animateOff()
 			setWledState(addr, "on", false)
-			state.active = false
+			state.Active = false
+		}
+	}
+	vis.save = func() {
+		savedState, saveState = state, nil
+		saveVisualizerState(layout.State, state)
+	}
+	vis.apply = func(s VisualizerState) {
+		briChanged := s.Brightness != state.Brightness
+		active := s.Active
+		s.Active = state.Active
+		state = s
+		if briChanged {
+			setWledState(addr, "bri", state.Brightness)
+		}
+		if active != state.Active {
+			vis.power(active)
+		} else if state.Active {
+			leds.Reset()
+			sendLeds()
 		}
 	}
 
-	return incommingMidi, power
+	return incommingMidi, vis
 }
 
 func noteToColor(note byte, velocity byte) RGB {
 	if velocity == 0 {
 		return noteToBkgColor(note)
 	}
+	level := velocityLevel(velocity)
+	return velocityBrightness(modeColor(note, velocityHueShift(level)), level)
+}
+
+// color of the note by the color mode, hue of colored modes is shifted by degrees
+func modeColor(note byte, shift int) RGB {
 	// white mode
-	switch state.colorMode {
+	switch state.ColorMode {
 	case MODE_WHITE:
 		return WHITE
 	case MODE_WHITE_WARM:
@@ -567,24 +824,24 @@ func noteToColor(note byte, velocity byte) RGB {
 	}
 	hue := 0
 	// rainbow modes
-	if state.colorMode >= MODE_RAINBOW_1 && state.colorMode <= MODE_RAINBOW_4 {
-		period := 12 * (state.colorMode - MODE_RAINBOW_1 + 1)             // define how much octaves the rainbow stretched
+	if state.ColorMode >= MODE_RAINBOW_1 && state.ColorMode <= MODE_RAINBOW_4 {
+		period := 12 * (state.ColorMode - MODE_RAINBOW_1 + 1)             // define how much octaves the rainbow stretched
 		frac := float64(((int(note)-24)+period)%period) / float64(period) // shift 24 to match with pian.co
 		hue = int(frac * 360)
 	} else
 	// solid color modes
-	if state.colorMode >= MODE_RED && state.colorMode <= MODE_MAGENTA_RED {
-		hue = (360 / 12) * (state.colorMode - MODE_RED)
+	if state.ColorMode >= MODE_RED && state.ColorMode <= MODE_MAGENTA_RED {
+		hue = (360 / 12) * (state.ColorMode - MODE_RED)
 	} else {
 		return BLACK
 	}
-	return colorHStoRGB(hue, state.saturation)
+	return colorHStoRGB((hue+shift+360)%360, state.Saturation)
 }
 
 func noteToBkgColor(note byte) RGB {
-	switch state.backgroundMode {
+	switch state.BackgroundMode {
 	case BKG_DIMMED:
-		return dimmedColor(noteToColor(note, 64))
+		return dimmedColor(modeColor(note, 0))
 	case BKG_LIGHT:
 		return dimmedColor(WHITE)
 	default:
@@ -638,9 +895,9 @@ func colorHStoRGB(hue int, sat byte) RGB {
 	return BLACK
 }
 
+// addr is base url of the wled json api
 func setWledState(addr string, field string, value interface{}) {
-	url := "http://" + strings.Split(addr, ":")[0] + ":80" // change the url to http
-	url += "/json/state"
+	url := addr + "/json/state"
 	json := fmt.Sprintf(
 		`{"v": false, "tt": 1, "%s": %v}`,
 		field, value,
@@ -655,9 +912,9 @@ func setWledState(addr string, field string, value interface{}) {
 	}
 }
 
+// addr is base url of the wled json api
 func getWledState(addr string, field string) interface{} {
-	url := "http://" + strings.Split(addr, ":")[0] + ":80" // change the url to http
-	url += "/json/state"
+	url := addr + "/json/state"
 
 	resp, err := http.Get(url)
 	if err != nil {